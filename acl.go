@@ -1,61 +1,78 @@
 package dockerauth
 
 import (
-	"net/http"
+	"sort"
 	"strings"
 )
 
-type actionList struct {
-	pull, push, star bool
+// actionOrder is the order of well known actions in an actionList slice. Any
+// other actions are sorted after these.
+var actionOrder = map[string]int{
+	"pull":   1,
+	"push":   2,
+	"delete": 3,
+	"*":      4,
 }
 
-func newActionList(actions []string) *actionList {
-	a := &actionList{}
+// actionList is a set of actions.
+type actionList map[string]bool
+
+func newActionList(actions []string) actionList {
+	a := actionList{}
 	a.addSlice(actions)
 	return a
 }
 
-func (a *actionList) add(action string) {
-	switch action {
-	case "pull":
-		a.pull = true
-	case "push":
-		a.push = true
-	case "*":
-		a.star = true
+func (a actionList) add(action string) {
+	if action != "" {
+		a[action] = true
 	}
 }
 
-func (a *actionList) addSlice(actions []string) {
+func (a actionList) addSlice(actions []string) {
 	for _, action := range actions {
 		a.add(action)
 	}
 }
 
-func (a *actionList) toSlice() []string {
-	actions := []string{}
-	if a.pull {
-		actions = append(actions, "pull")
-	}
-	if a.push {
-		actions = append(actions, "push")
-	}
-	if a.star {
-		actions = append(actions, "*")
+func (a actionList) remove(action string) {
+	delete(a, action)
+}
+
+func (a actionList) toSlice() []string {
+	actions := make([]string, 0, len(a))
+	for action := range a {
+		actions = append(actions, action)
 	}
+
+	sort.Slice(actions, func(i, j int) bool {
+		oi, oj := actionOrder[actions[i]], actionOrder[actions[j]]
+		if oi == 0 && oj == 0 {
+			return actions[i] < actions[j]
+		}
+		if oi == 0 || oj == 0 {
+			return oj == 0
+		}
+		return oi < oj
+	})
 	return actions
 }
 
-func (a *actionList) intersect(a2 *actionList) *actionList {
-	return &actionList{
-		pull: a.pull && a2.pull,
-		push: a.push && a2.push,
-		star: a.star && a2.star,
+func (a actionList) intersect(a2 actionList) actionList {
+	i := actionList{}
+	for action := range a {
+		if a2[action] {
+			i[action] = true
+		}
 	}
+	return i
 }
 
+// AccessControl grants actions on resources matching Name. Permissions with a
+// Service only apply to the registry of that name.
 type AccessControl struct {
 	IP      string   `json:"-"`
+	Service string   `json:"-"`
 	Type    string   `json:"type"`
 	Name    string   `json:"name"`
 	Actions []string `json:"actions"`
@@ -80,6 +97,51 @@ func parseScope(sc string) *AccessControl {
 	return a
 }
 
+// groupACLs returns the permissions of the configured groups matching any of
+// groups. Group names must match exactly, except LDAP DNs which are compared
+// as DNs, ignoring case.
+func groupACLs(configured []*GroupConfig, groups []string) []*AccessControl {
+	var acls []*AccessControl
+	for _, group := range configured {
+		for _, name := range groups {
+			if group.Name == name || ldapDNEqual(group.Name, name) {
+				acls = append(acls, group.Permissions...)
+				break
+			}
+		}
+	}
+	return acls
+}
+
+// filterService returns the ACLs which apply to the registry named service.
+// ACLs without a service apply to every registry.
+func filterService(acls []*AccessControl, service string) []*AccessControl {
+	newAcls := make([]*AccessControl, 0, len(acls))
+	for _, acl := range acls {
+		if acl.Service == "" || acl.Service == service {
+			newAcls = append(newAcls, acl)
+		}
+	}
+	return newAcls
+}
+
+// filterType returns the ACLs which apply to resources of type typ. ACLs
+// without a type apply to repositories. Other resource types, such as the
+// registry catalog, must be granted explicitly.
+func (a *Authenticator) filterType(acls []*AccessControl, typ string) []*AccessControl {
+	newAcls := make([]*AccessControl, 0, len(acls))
+	for _, acl := range acls {
+		aclType := acl.Type
+		if aclType == "" {
+			aclType = "repository"
+		}
+		if aclType == typ {
+			newAcls = append(newAcls, acl)
+		}
+	}
+	return newAcls
+}
+
 func (a *Authenticator) filterRepository(acls []*AccessControl, repo string) []*AccessControl {
 	var newAcls []*AccessControl
 	for _, acl := range acls {
@@ -94,14 +156,18 @@ func (a *Authenticator) filterRepository(acls []*AccessControl, repo string) []*
 	return newAcls
 }
 
-func (a *Authenticator) checkIPAddress(r *http.Request, acls []*AccessControl) bool {
-	ip := r.RemoteAddr
-	if realIP := r.Header.Get(http.CanonicalHeaderKey("X-Real-IP")); realIP != "" {
-		ip = strings.SplitAfterN(realIP, ":", 2)[0]
-	}
-
+// checkIPAddress checks the client's address is allowed by every ACL. ACLs
+// with malformed IP lists never match, and clients without a parsable
+// address only match ACLs allowing any address.
+func (a *Authenticator) checkIPAddress(clientIP string, acls []*AccessControl) bool {
+	ip, _ := parseHostIP(clientIP)
 	for _, acl := range acls {
-		if !globMatch(acl.IP, ip) {
+		l, err := parseIPList(acl.IP)
+		if err != nil {
+			a.log.Errorf("Permission for %q denied: %s\n", acl.Name, err)
+			return false
+		}
+		if !l.contains(ip) {
 			return false
 		}
 	}
@@ -129,3 +195,22 @@ func (a *Authenticator) compareACLS(acls []*AccessControl, req *AccessControl) *
 		Actions: allowedActions.intersect(reqActions).toSlice(),
 	}
 }
+
+// applyRegistryPolicy removes actions from a granted access claim which the
+// registry configuration doesn't allow regardless of user permissions. The
+// registry treats * on a repository as every action including delete, so it's
+// narrowed to pull and push when deleting isn't allowed.
+func (reg *registry) applyRegistryPolicy(resp *AccessControl) *AccessControl {
+	if reg.AllowDelete {
+		return resp
+	}
+
+	actions := newActionList(resp.Actions)
+	actions.remove("delete")
+	if actions["*"] && (resp.Type == "" || resp.Type == "repository") {
+		actions.remove("*")
+		actions.addSlice([]string{"pull", "push"})
+	}
+	resp.Actions = actions.toSlice()
+	return resp
+}
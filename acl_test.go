@@ -1,7 +1,8 @@
 package dockerauth
 
 import (
-	"net/http"
+	"errors"
+	"net/netip"
 	"testing"
 )
 
@@ -48,39 +49,49 @@ func TestScopeParse(t *testing.T) {
 
 var actionListTests = []struct {
 	init     []string
-	equal    *actionList
+	equal    actionList
 	expected []string
 }{
 	{
 		init:     []string{},
-		equal:    &actionList{},
+		equal:    actionList{},
 		expected: []string{},
 	},
 	{
 		init:     []string{"pull"},
-		equal:    &actionList{pull: true},
+		equal:    actionList{"pull": true},
 		expected: []string{"pull"},
 	},
 	{
 		init:     []string{"something"},
-		equal:    &actionList{},
-		expected: []string{},
+		equal:    actionList{"something": true},
+		expected: []string{"something"},
 	},
 	{
 		init:     []string{"pull", "push"},
-		equal:    &actionList{pull: true, push: true},
+		equal:    actionList{"pull": true, "push": true},
 		expected: []string{"pull", "push"},
 	},
 	{
 		init:     []string{"push", "pull"},
-		equal:    &actionList{pull: true, push: true},
+		equal:    actionList{"pull": true, "push": true},
 		expected: []string{"pull", "push"},
 	},
 	{
 		init:     []string{"pull", "push", "*"},
-		equal:    &actionList{pull: true, push: true, star: true},
+		equal:    actionList{"pull": true, "push": true, "*": true},
 		expected: []string{"pull", "push", "*"},
 	},
+	{
+		init:     []string{"delete", "push", "pull"},
+		equal:    actionList{"pull": true, "push": true, "delete": true},
+		expected: []string{"pull", "push", "delete"},
+	},
+	{
+		init:     []string{"zap", "pull", "*", "bar", "delete", ""},
+		equal:    actionList{"pull": true, "delete": true, "*": true, "bar": true, "zap": true},
+		expected: []string{"pull", "delete", "*", "bar", "zap"},
+	},
 }
 
 func TestActionList(t *testing.T) {
@@ -94,32 +105,37 @@ func TestActionList(t *testing.T) {
 var actionListAddTests = []struct {
 	init     []string
 	add      []string
-	expected *actionList
+	expected actionList
 }{
 	{
 		init:     []string{},
 		add:      []string{},
-		expected: &actionList{},
+		expected: actionList{},
 	},
 	{
 		init:     []string{"pull"},
 		add:      []string{},
-		expected: &actionList{pull: true},
+		expected: actionList{"pull": true},
 	},
 	{
 		init:     []string{},
 		add:      []string{"push"},
-		expected: &actionList{push: true},
+		expected: actionList{"push": true},
 	},
 	{
 		init:     []string{"pull"},
 		add:      []string{"push"},
-		expected: &actionList{pull: true, push: true},
+		expected: actionList{"pull": true, "push": true},
 	},
 	{
 		init:     []string{"push"},
 		add:      []string{"*"},
-		expected: &actionList{push: true, star: true},
+		expected: actionList{"push": true, "*": true},
+	},
+	{
+		init:     []string{"push"},
+		add:      []string{"delete"},
+		expected: actionList{"push": true, "delete": true},
 	},
 }
 
@@ -142,34 +158,39 @@ func TestActionListAdd(t *testing.T) {
 }
 
 var actionListIntersectionTests = []struct {
-	a1        *actionList
-	a2        *actionList
-	intersect *actionList
+	a1        actionList
+	a2        actionList
+	intersect actionList
 }{
 	{
-		a1:        &actionList{},
-		a2:        &actionList{},
-		intersect: &actionList{},
+		a1:        actionList{},
+		a2:        actionList{},
+		intersect: actionList{},
 	},
 	{
-		a1:        &actionList{push: true},
-		a2:        &actionList{},
-		intersect: &actionList{},
+		a1:        actionList{"push": true},
+		a2:        actionList{},
+		intersect: actionList{},
 	},
 	{
-		a1:        &actionList{},
-		a2:        &actionList{push: true},
-		intersect: &actionList{},
+		a1:        actionList{},
+		a2:        actionList{"push": true},
+		intersect: actionList{},
 	},
 	{
-		a1:        &actionList{push: true},
-		a2:        &actionList{pull: true, push: true},
-		intersect: &actionList{push: true},
+		a1:        actionList{"push": true},
+		a2:        actionList{"pull": true, "push": true},
+		intersect: actionList{"push": true},
 	},
 	{
-		a1:        &actionList{push: true, star: true},
-		a2:        &actionList{pull: true, push: true, star: true},
-		intersect: &actionList{push: true, star: true},
+		a1:        actionList{"push": true, "*": true},
+		a2:        actionList{"pull": true, "push": true, "*": true},
+		intersect: actionList{"push": true, "*": true},
+	},
+	{
+		a1:        actionList{"pull": true, "delete": true},
+		a2:        actionList{"delete": true},
+		intersect: actionList{"delete": true},
 	},
 }
 
@@ -272,30 +293,94 @@ var checkIPTests = []struct {
 		},
 		expected: false,
 	},
+	{
+		ip: "10.20.30.40:51234",
+		acls: []*AccessControl{
+			&AccessControl{IP: "10.0.0.0/8"},
+		},
+		expected: true,
+	},
+	{
+		ip: "11.0.0.1",
+		acls: []*AccessControl{
+			&AccessControl{IP: "10.0.0.0/8"},
+		},
+		expected: false,
+	},
+	{
+		ip: "192.168.1.5",
+		acls: []*AccessControl{
+			&AccessControl{IP: "10.0.0.0/8, 192.168.1.5"},
+		},
+		expected: true,
+	},
+	{
+		ip: "[fd00::1]:51234",
+		acls: []*AccessControl{
+			&AccessControl{IP: "10.0.0.0/8 fd00::/8"},
+		},
+		expected: true,
+	},
+	{
+		ip: "::ffff:10.1.2.3",
+		acls: []*AccessControl{
+			&AccessControl{IP: "10.1.0.0/16"},
+		},
+		expected: true,
+	},
+	{
+		ip: "10.1.2.3",
+		acls: []*AccessControl{
+			&AccessControl{IP: "*"},
+			&AccessControl{IP: "10.2.0.0/16"},
+		},
+		expected: false,
+	},
+	{
+		ip: "10.1.2.3",
+		acls: []*AccessControl{
+			&AccessControl{IP: "10.1.2.300"},
+		},
+		expected: false,
+	},
 }
 
-func TestACLIPFilter(t *testing.T) {
-	a := &Authenticator{}
-
-	for _, test := range checkIPTests {
-		r, _ := http.NewRequest("", "", nil)
-		r.RemoteAddr = test.ip
+var parseIPListTests = []struct {
+	list     string
+	expected *ipList
+	valid    bool
+}{
+	{"*", &ipList{any: true}, true},
+	{"10.0.0.1", &ipList{prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")}}, true},
+	{"10.1.2.3/8", &ipList{prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}, true},
+	{"10.1.*", &ipList{prefixes: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}}, true},
+	{"::ffff:10.0.0.0/104", &ipList{prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}, true},
+	{"fd00::/8,10.0.0.1", &ipList{prefixes: []netip.Prefix{
+		netip.MustParsePrefix("fd00::/8"), netip.MustParsePrefix("10.0.0.1/32")}}, true},
+	{"", nil, false},
+	{"10.0.0.0/33", nil, false},
+	{"10.*.1.1", nil, false},
+	{"10*", nil, false},
+	{"localhost", nil, false},
+}
 
-		check := a.checkIPAddress(r, test.acls)
-		assert(t, check == test.expected,
-			"IP address check error. Got %t, expected %t",
-			check, test.expected)
+func TestParseIPList(t *testing.T) {
+	for _, test := range parseIPListTests {
+		l, err := parseIPList(test.list)
+		if !test.valid {
+			assert(t, errors.Is(err, ErrInvalidIPList), "Expected %q to be invalid, got %v", test.list, err)
+			continue
+		}
+		ok(t, err)
+		equals(t, l, test.expected)
 	}
 }
 
-func TestACLIPFilterHeader(t *testing.T) {
-	a := &Authenticator{}
+func TestACLIPFilter(t *testing.T) {
+	a := &Authenticator{log: &nullLogger{}}
 
 	for _, test := range checkIPTests {
-		r, _ := http.NewRequest("", "", nil)
-		r.Header.Set(http.CanonicalHeaderKey("X-Real-IP"), test.ip)
-
-		check := a.checkIPAddress(r, test.acls)
+		check := a.checkIPAddress(test.ip, test.acls)
 		assert(t, check == test.expected,
 			"IP address check error. Got %t, expected %t",
 			check, test.expected)
@@ -371,3 +456,128 @@ func TestCompareACLs(t *testing.T) {
 		equals(t, res, test.result)
 	}
 }
+
+var registryPolicyTests = []struct {
+	allowDelete bool
+	acls        []*AccessControl
+	req         *AccessControl
+	result      *AccessControl
+}{
+	{
+		allowDelete: true,
+		acls: []*AccessControl{
+			&AccessControl{Actions: []string{"pull", "delete"}},
+		},
+		req:    &AccessControl{Actions: []string{"pull", "delete"}},
+		result: &AccessControl{Actions: []string{"pull", "delete"}},
+	},
+	{
+		allowDelete: false,
+		acls: []*AccessControl{
+			&AccessControl{Actions: []string{"pull", "delete"}},
+		},
+		req:    &AccessControl{Actions: []string{"pull", "delete"}},
+		result: &AccessControl{Actions: []string{"pull"}},
+	},
+	{
+		allowDelete: true,
+		acls: []*AccessControl{
+			&AccessControl{Actions: []string{"pull", "push"}},
+		},
+		req:    &AccessControl{Actions: []string{"pull", "delete"}},
+		result: &AccessControl{Actions: []string{"pull"}},
+	},
+	{
+		allowDelete: false,
+		acls: []*AccessControl{
+			&AccessControl{Actions: []string{"*"}},
+		},
+		req:    &AccessControl{Type: "repository", Actions: []string{"*"}},
+		result: &AccessControl{Type: "repository", Actions: []string{"pull", "push"}},
+	},
+	{
+		allowDelete: true,
+		acls: []*AccessControl{
+			&AccessControl{Actions: []string{"*"}},
+		},
+		req:    &AccessControl{Type: "repository", Actions: []string{"*"}},
+		result: &AccessControl{Type: "repository", Actions: []string{"*"}},
+	},
+	{
+		allowDelete: false,
+		acls: []*AccessControl{
+			&AccessControl{Actions: []string{"*"}},
+		},
+		req:    &AccessControl{Type: "registry", Name: "catalog", Actions: []string{"*"}},
+		result: &AccessControl{Type: "registry", Name: "catalog", Actions: []string{"*"}},
+	},
+}
+
+func TestRegistryPolicy(t *testing.T) {
+	a := &Authenticator{}
+	reg := &registry{RegistryConfig: &RegistryConfig{}}
+
+	for _, test := range registryPolicyTests {
+		reg.AllowDelete = test.allowDelete
+		res := reg.applyRegistryPolicy(a.compareACLS(test.acls, test.req))
+		equals(t, res, test.result)
+	}
+}
+
+func TestACLDeleteFromAccountsFile(t *testing.T) {
+	fa, err := NewFileAuthenticator("testdata/accounts.toml")
+	ok(t, err)
+
+	acls, err := fa.GetACLS("test")
+	ok(t, err)
+
+	a := &Authenticator{}
+	acls = a.filterRepository(acls, "test/image")
+	res := a.compareACLS(acls, &AccessControl{Actions: []string{"pull", "delete"}})
+	equals(t, res.Actions, []string{"pull", "delete"})
+}
+
+func TestACLTypeFilter(t *testing.T) {
+	a := &Authenticator{}
+	acls := []*AccessControl{
+		{Name: "alpine"},
+		{Type: "repository", Name: "ubuntu"},
+		{Type: "registry", Name: "catalog"},
+	}
+
+	equals(t, a.filterType(acls, "repository"), acls[:2])
+	equals(t, a.filterType(acls, "registry"), acls[2:])
+	equals(t, a.filterType(acls, "other"), []*AccessControl{})
+}
+
+func TestGroupACLs(t *testing.T) {
+	fa, err := NewFileAuthenticator("testdata/accounts.toml")
+	ok(t, err)
+
+	config := newTestConfig()
+	config.Group = []*GroupConfig{
+		{Name: "developers", Permissions: []*AccessControl{{IP: "*", Name: "dev/**", Actions: []string{"push", "pull"}}}},
+		{Name: "ops", Permissions: []*AccessControl{{IP: "*", Name: "**", Actions: []string{"*"}}}},
+	}
+	a := NewAuthenticator(&Options{
+		Config:             config,
+		UserAuthenticator:  fa,
+		AccessControlStore: fa,
+	})
+
+	userACLs, err := fa.GetACLS("test")
+	ok(t, err)
+
+	acls, err := a.getACLS(a.getConfig(), testRegistry(a), "test")
+	ok(t, err)
+	equals(t, acls, append(userACLs[:len(userACLs):len(userACLs)], config.Group[0].Permissions...))
+
+	userACLs, err = fa.GetACLS("test")
+	ok(t, err)
+	equals(t, len(userACLs), 3)
+
+	// Users without groups only have their own permissions
+	acls, err = a.getACLS(a.getConfig(), testRegistry(a), "admin")
+	ok(t, err)
+	equals(t, len(acls), 2)
+}
@@ -0,0 +1,373 @@
+package dockerauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	passlib "gopkg.in/hlandau/passlib.v1"
+)
+
+const AdminPath = "/admin/"
+
+var (
+	ErrForbidden      = errors.New("Forbidden")
+	ErrNotFound       = errors.New("Not found")
+	ErrUserNotFound   = errors.New("User not found")
+	ErrUserExists     = errors.New("User already exists")
+	ErrStoreReadOnly  = errors.New("User store can't be modified")
+	ErrInvalidRequest = errors.New("Invalid request")
+)
+
+// UserStore is implemented by AccessControlStores whose users can be managed
+// through the admin API. Passwords are always passlib hashes.
+type UserStore interface {
+	ListUsers() ([]*UserConfig, error)
+	GetUser(username string) (*UserConfig, error)
+	CreateUser(user *UserConfig) error
+	UpdateUser(user *UserConfig) error
+	DeleteUser(username string) error
+}
+
+// adminUser is a user in admin API requests and responses. Password is only
+// used in requests, it's hashed before being stored.
+type adminUser struct {
+	Username    string             `json:"username"`
+	Password    string             `json:"password,omitempty"`
+	Groups      []string           `json:"groups"`
+	Permissions []*adminPermission `json:"permissions"`
+}
+
+type adminPermission struct {
+	IP         string   `json:"ip"`
+	Service    string   `json:"service,omitempty"`
+	Type       string   `json:"type,omitempty"`
+	Repository string   `json:"repository"`
+	Actions    []string `json:"actions"`
+}
+
+type adminPassword struct {
+	Password string `json:"password"`
+}
+
+func newAdminUser(u *UserConfig) *adminUser {
+	user := &adminUser{
+		Username:    u.Username,
+		Groups:      u.Groups,
+		Permissions: newAdminPermissions(u.Permissions),
+	}
+	if user.Groups == nil {
+		user.Groups = []string{}
+	}
+	return user
+}
+
+func newAdminPermissions(acls []*AccessControl) []*adminPermission {
+	perms := make([]*adminPermission, len(acls))
+	for i, acl := range acls {
+		perms[i] = &adminPermission{
+			IP:         acl.IP,
+			Service:    acl.Service,
+			Type:       acl.Type,
+			Repository: acl.Name,
+			Actions:    acl.Actions,
+		}
+	}
+	return perms
+}
+
+// accessControls validates perms and converts them to ACLs. An empty IP
+// matches any address.
+func accessControls(perms []*adminPermission) ([]*AccessControl, error) {
+	acls := make([]*AccessControl, len(perms))
+	for i, p := range perms {
+		if p == nil || p.Repository == "" || len(p.Actions) == 0 {
+			return nil, fmt.Errorf("%w: permissions need a repository and actions", ErrInvalidRequest)
+		}
+		if p.IP == "" {
+			p.IP = "*"
+		}
+		if _, err := parseIPList(p.IP); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidRequest, err)
+		}
+		acls[i] = &AccessControl{
+			IP:      p.IP,
+			Service: p.Service,
+			Type:    p.Type,
+			Name:    p.Repository,
+			Actions: p.Actions,
+		}
+	}
+	return acls, nil
+}
+
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", fmt.Errorf("%w: password is empty", ErrInvalidRequest)
+	}
+	return passlib.Hash(password)
+}
+
+// ProcessAdminRequest serves the admin API under AdminPath:
+//
+//	GET    /admin/users                    list users
+//	POST   /admin/users                    create a user
+//	GET    /admin/users/{name}             get a user
+//	PUT    /admin/users/{name}             replace a user's groups and permissions, and password if given
+//	DELETE /admin/users/{name}             delete a user
+//	PUT    /admin/users/{name}/password    reset a user's password
+//	GET    /admin/users/{name}/permissions get a user's permissions
+//	PUT    /admin/users/{name}/permissions replace a user's permissions
+//
+// Requests must use basic authentication as one of the configured admin users.
+func (a *Authenticator) ProcessAdminRequest(w http.ResponseWriter, r *http.Request) error {
+	if err := a.authorizeAdmin(a.getConfig(), r); err != nil {
+		return err
+	}
+
+	store, ok := a.accessControlStore.(UserStore)
+	if !ok {
+		return ErrStoreReadOnly
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, AdminPath), "/"), "/")
+	if parts[0] != "users" || len(parts) > 3 {
+		return ErrNotFound
+	}
+
+	switch len(parts) {
+	case 1:
+		switch r.Method {
+		case http.MethodGet:
+			return a.adminListUsers(w, store)
+		case http.MethodPost:
+			return a.adminCreateUser(w, r, store)
+		}
+	case 2:
+		switch r.Method {
+		case http.MethodGet:
+			return a.adminGetUser(w, store, parts[1])
+		case http.MethodPut:
+			return a.adminUpdateUser(w, r, store, parts[1])
+		case http.MethodDelete:
+			return a.adminDeleteUser(w, store, parts[1])
+		}
+	case 3:
+		switch {
+		case parts[2] == "password" && r.Method == http.MethodPut:
+			return a.adminResetPassword(w, r, store, parts[1])
+		case parts[2] == "permissions" && r.Method == http.MethodGet:
+			return a.adminGetPermissions(w, store, parts[1])
+		case parts[2] == "permissions" && r.Method == http.MethodPut:
+			return a.adminSetPermissions(w, r, store, parts[1])
+		case parts[2] != "password" && parts[2] != "permissions":
+			return ErrNotFound
+		}
+	}
+	return ErrMethodNotAllowed
+}
+
+// authorizeAdmin checks the request's credentials belong to an admin user.
+func (a *Authenticator) authorizeAdmin(c *authConfig, r *http.Request) error {
+	username, password := a.GetBasicCredentials(r)
+	if username == "" {
+		return ErrInvalidLogin
+	}
+
+	ok, err := a.userLogin(username, password, c.clientIP(r))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidLogin
+	}
+
+	if c.Admin == nil || !c.Admin.Enabled || !stringInSlice(username, c.Admin.Users) {
+		a.log.Printf("User %s is not an admin\n", username)
+		return ErrForbidden
+	}
+	return nil
+}
+
+func (a *Authenticator) adminListUsers(w http.ResponseWriter, store UserStore) error {
+	users, err := store.ListUsers()
+	if err != nil {
+		return err
+	}
+
+	resp := make([]*adminUser, len(users))
+	for i, u := range users {
+		resp[i] = newAdminUser(u)
+	}
+	return writeAdminResponse(w, http.StatusOK, resp)
+}
+
+func (a *Authenticator) adminCreateUser(w http.ResponseWriter, r *http.Request, store UserStore) error {
+	req := &adminUser{}
+	if err := decodeAdminRequest(r, req); err != nil {
+		return err
+	}
+	if req.Username == "" || strings.Contains(req.Username, "/") {
+		return fmt.Errorf("%w: invalid username", ErrInvalidRequest)
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		return err
+	}
+	acls, err := accessControls(req.Permissions)
+	if err != nil {
+		return err
+	}
+
+	user := &UserConfig{
+		Username:    req.Username,
+		Password:    hash,
+		Groups:      req.Groups,
+		Permissions: acls,
+	}
+	if err := store.CreateUser(user); err != nil {
+		return err
+	}
+
+	a.metrics.resetUserStats()
+
+	a.log.Printf("Admin created user %s\n", user.Username)
+	return writeAdminResponse(w, http.StatusCreated, newAdminUser(user))
+}
+
+func (a *Authenticator) adminGetUser(w http.ResponseWriter, store UserStore, username string) error {
+	user, err := store.GetUser(username)
+	if err != nil {
+		return err
+	}
+	return writeAdminResponse(w, http.StatusOK, newAdminUser(user))
+}
+
+func (a *Authenticator) adminUpdateUser(w http.ResponseWriter, r *http.Request, store UserStore, username string) error {
+	req := &adminUser{}
+	if err := decodeAdminRequest(r, req); err != nil {
+		return err
+	}
+	if req.Username != "" && req.Username != username {
+		return fmt.Errorf("%w: users can't be renamed", ErrInvalidRequest)
+	}
+
+	acls, err := accessControls(req.Permissions)
+	if err != nil {
+		return err
+	}
+
+	user, err := store.GetUser(username)
+	if err != nil {
+		return err
+	}
+	if req.Password != "" {
+		if user.Password, err = hashPassword(req.Password); err != nil {
+			return err
+		}
+		user.Hash = ""
+	}
+	user.Groups = req.Groups
+	user.Permissions = acls
+
+	if err := store.UpdateUser(user); err != nil {
+		return err
+	}
+
+	a.ForgetCredentials(username)
+	a.metrics.resetUserStats()
+	a.log.Printf("Admin updated user %s\n", username)
+	return writeAdminResponse(w, http.StatusOK, newAdminUser(user))
+}
+
+func (a *Authenticator) adminDeleteUser(w http.ResponseWriter, store UserStore, username string) error {
+	if err := store.DeleteUser(username); err != nil {
+		return err
+	}
+
+	a.ForgetCredentials(username)
+	a.metrics.resetUserStats()
+	a.log.Printf("Admin deleted user %s\n", username)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (a *Authenticator) adminResetPassword(w http.ResponseWriter, r *http.Request, store UserStore, username string) error {
+	req := &adminPassword{}
+	if err := decodeAdminRequest(r, req); err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		return err
+	}
+
+	user, err := store.GetUser(username)
+	if err != nil {
+		return err
+	}
+	user.Password = hash
+	user.Hash = ""
+
+	if err := store.UpdateUser(user); err != nil {
+		return err
+	}
+
+	a.ForgetCredentials(username)
+	a.log.Printf("Admin reset password of user %s\n", username)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (a *Authenticator) adminGetPermissions(w http.ResponseWriter, store UserStore, username string) error {
+	user, err := store.GetUser(username)
+	if err != nil {
+		return err
+	}
+	return writeAdminResponse(w, http.StatusOK, newAdminPermissions(user.Permissions))
+}
+
+func (a *Authenticator) adminSetPermissions(w http.ResponseWriter, r *http.Request, store UserStore, username string) error {
+	var req []*adminPermission
+	if err := decodeAdminRequest(r, &req); err != nil {
+		return err
+	}
+
+	acls, err := accessControls(req)
+	if err != nil {
+		return err
+	}
+
+	user, err := store.GetUser(username)
+	if err != nil {
+		return err
+	}
+	user.Permissions = acls
+
+	if err := store.UpdateUser(user); err != nil {
+		return err
+	}
+
+	a.metrics.resetUserStats()
+	a.log.Printf("Admin updated permissions of user %s\n", username)
+	return writeAdminResponse(w, http.StatusOK, newAdminPermissions(user.Permissions))
+}
+
+func decodeAdminRequest(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidRequest, err)
+	}
+	return nil
+}
+
+func writeAdminResponse(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,160 @@
+package dockerauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestAdminAuthenticator(t *testing.T) (*Authenticator, *FileAuthenticator) {
+	buf, err := os.ReadFile("testdata/accounts.toml")
+	ok(t, err)
+	path := filepath.Join(t.TempDir(), "accounts.toml")
+	ok(t, os.WriteFile(path, buf, 0600))
+
+	fa, err := NewFileAuthenticator(path)
+	ok(t, err)
+
+	config := newTestConfig()
+	config.Admin = &AdminConfig{Enabled: true, Users: []string{"admin"}}
+
+	return NewAuthenticator(&Options{
+		Config:             config,
+		UserAuthenticator:  fa,
+		AccessControlStore: fa,
+	}), fa
+}
+
+func adminRequest(t *testing.T, a *Authenticator, method, path string, body interface{}, v interface{}) (int, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		ok(t, json.NewEncoder(&buf).Encode(body))
+	}
+
+	req := httptest.NewRequest(method, path, &buf)
+	req.SetBasicAuth("admin", "admin")
+	rec := httptest.NewRecorder()
+
+	if err := a.ProcessAdminRequest(rec, req); err != nil {
+		return 0, err
+	}
+	if v != nil {
+		ok(t, json.NewDecoder(rec.Body).Decode(v))
+	}
+	return rec.Code, nil
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	a, _ := newTestAdminAuthenticator(t)
+
+	req := httptest.NewRequest("GET", "/admin/users", nil)
+	equals(t, a.ProcessAdminRequest(httptest.NewRecorder(), req), ErrInvalidLogin)
+
+	req.SetBasicAuth("admin", "wrong")
+	equals(t, a.ProcessAdminRequest(httptest.NewRecorder(), req), ErrInvalidLogin)
+
+	req.SetBasicAuth("test", "testing")
+	equals(t, a.ProcessAdminRequest(httptest.NewRecorder(), req), ErrForbidden)
+
+	a.getConfig().Admin.Enabled = false
+	req.SetBasicAuth("admin", "admin")
+	equals(t, a.ProcessAdminRequest(httptest.NewRecorder(), req), ErrForbidden)
+
+	// Stores which can't be modified
+	a = newTestAuthenticator()
+	a.getConfig().Admin = &AdminConfig{Enabled: true, Users: []string{"test"}}
+	req.SetBasicAuth("test", "testing")
+	equals(t, a.ProcessAdminRequest(httptest.NewRecorder(), req), ErrStoreReadOnly)
+}
+
+func TestAdminUsers(t *testing.T) {
+	a, fa := newTestAdminAuthenticator(t)
+
+	var users []*adminUser
+	code, err := adminRequest(t, a, "GET", "/admin/users", nil, &users)
+	ok(t, err)
+	equals(t, code, http.StatusOK)
+	equals(t, len(users), 2)
+	equals(t, users[1].Username, "test")
+	equals(t, users[1].Groups, []string{"developers"})
+
+	robot := &adminUser{
+		Username: "robot",
+		Password: "secret",
+		Groups:   []string{"ci"},
+		Permissions: []*adminPermission{
+			{Repository: "builds/**", Actions: []string{"push", "pull"}},
+		},
+	}
+	code, err = adminRequest(t, a, "POST", "/admin/users", robot, nil)
+	ok(t, err)
+	equals(t, code, http.StatusCreated)
+
+	_, err = adminRequest(t, a, "POST", "/admin/users", robot, nil)
+	equals(t, err, ErrUserExists)
+
+	login, err := fa.Login("robot", "secret")
+	ok(t, err)
+	assert(t, login, "Login failed for created user")
+
+	// Changes are written to the accounts file
+	reloaded, err := NewFileAuthenticator(fa.filename)
+	ok(t, err)
+	login, err = reloaded.Login("robot", "secret")
+	ok(t, err)
+	assert(t, login, "Login failed for created user after reload")
+	acls, err := reloaded.GetACLS("robot")
+	ok(t, err)
+	equals(t, acls, []*AccessControl{{IP: "*", Name: "builds/**", Actions: []string{"push", "pull"}}})
+
+	// Settings not managed by the API are kept
+	lifetime, err := reloaded.GetTokenLifetime("test")
+	ok(t, err)
+	equals(t, lifetime.TTL.String(), "8h0m0s")
+
+	code, err = adminRequest(t, a, "PUT", "/admin/users/robot/password", &adminPassword{Password: "new"}, nil)
+	ok(t, err)
+	equals(t, code, http.StatusNoContent)
+	login, err = fa.Login("robot", "secret")
+	ok(t, err)
+	assert(t, !login, "Login succeeded with old password")
+	login, err = fa.Login("robot", "new")
+	ok(t, err)
+	assert(t, login, "Login failed with new password")
+
+	var perms []*adminPermission
+	_, err = a.metrics.getUserStats(fa)
+	ok(t, err)
+	code, err = adminRequest(t, a, "PUT", "/admin/users/robot/permissions", []*adminPermission{
+		{IP: "10.*", Type: "registry", Repository: "catalog", Actions: []string{"*"}},
+	}, &perms)
+	ok(t, err)
+	equals(t, code, http.StatusOK)
+	equals(t, perms[0].Type, "registry")
+	assert(t, a.metrics.userStats == nil, "User metrics weren't reset")
+
+	acls, err = fa.GetACLS("robot")
+	ok(t, err)
+	equals(t, acls, []*AccessControl{{IP: "10.*", Type: "registry", Name: "catalog", Actions: []string{"*"}}})
+
+	_, err = adminRequest(t, a, "PUT", "/admin/users/robot/permissions", []*adminPermission{{IP: "*"}}, nil)
+	assert(t, errors.Is(err, ErrInvalidRequest), "Expected invalid request, got %v", err)
+
+	code, err = adminRequest(t, a, "DELETE", "/admin/users/robot", nil, nil)
+	ok(t, err)
+	equals(t, code, http.StatusNoContent)
+
+	_, err = adminRequest(t, a, "GET", "/admin/users/robot", nil, nil)
+	equals(t, err, ErrUserNotFound)
+
+	_, err = adminRequest(t, a, "PATCH", "/admin/users/test", nil, nil)
+	equals(t, err, ErrMethodNotAllowed)
+
+	_, err = adminRequest(t, a, "GET", "/admin/groups", nil, nil)
+	equals(t, err, ErrNotFound)
+}
@@ -0,0 +1,224 @@
+package dockerauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reasons requested actions weren't granted, recorded per scope in the audit
+// log.
+const (
+	auditNoMatchingRule = "no matching permission"
+	auditIPNotAllowed   = "client IP not allowed"
+	auditDeleteDisabled = "delete not allowed by registry"
+	auditNotPermitted   = "actions not permitted"
+)
+
+// AuditEvent records a token request and the decision made on it.
+type AuditEvent struct {
+	Time     time.Time     `json:"time"`
+	Path     string        `json:"path"`
+	Username string        `json:"username"`
+	ClientIP string        `json:"client_ip"`
+	Service  string        `json:"service"`
+	Scopes   []*AuditScope `json:"scopes"`
+	Error    string        `json:"error,omitempty"` // Why the request was denied
+	TokenID  string        `json:"jti,omitempty"`
+}
+
+// AuditScope is the decision on one requested scope.
+type AuditScope struct {
+	Scope   string       `json:"scope"`
+	Granted []string     `json:"granted"`
+	Rules   []*AuditRule `json:"rules,omitempty"` // Permissions matching the scope
+	Denied  string       `json:"denied,omitempty"`
+}
+
+// AuditRule is a permission which matched a requested scope.
+type AuditRule struct {
+	IP         string   `json:"ip"`
+	Service    string   `json:"service,omitempty"`
+	Type       string   `json:"type,omitempty"`
+	Repository string   `json:"repository"`
+	Actions    []string `json:"actions"`
+}
+
+func newAuditRules(acls []*AccessControl) []*AuditRule {
+	rules := make([]*AuditRule, len(acls))
+	for i, acl := range acls {
+		rules[i] = &AuditRule{
+			IP:         acl.IP,
+			Service:    acl.Service,
+			Type:       acl.Type,
+			Repository: acl.Name,
+			Actions:    acl.Actions,
+		}
+	}
+	return rules
+}
+
+// AuditLog writes audit events as JSON lines. It's safe for concurrent use.
+type AuditLog struct {
+	m sync.Mutex
+	w io.Writer
+}
+
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+// Log writes e as a single line.
+func (l *AuditLog) Log(e *AuditEvent) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+	_, err = l.w.Write(append(buf, '\n'))
+	return err
+}
+
+// newAuditEvent starts the audit record of request r.
+func newAuditEvent(c *authConfig, r *http.Request, service, username string) *AuditEvent {
+	return &AuditEvent{
+		Time:     time.Now().UTC(),
+		Path:     r.URL.Path,
+		Username: username,
+		ClientIP: c.clientIP(r),
+		Service:  service,
+		Scopes:   []*AuditScope{},
+	}
+}
+
+// audit writes e to the audit log, if there is one, recording err as the
+// reason the request was denied.
+func (a *Authenticator) audit(e *AuditEvent, err error) {
+	if a.auditLog == nil {
+		return
+	}
+
+	if err != nil {
+		e.Error = err.Error()
+		e.TokenID = ""
+	}
+	if err := a.auditLog.Log(e); err != nil {
+		a.log.Errorf("Writing audit log failed: %s\n", err)
+	}
+}
+
+// RotatingFile is an append only file which is rotated once it grows past a
+// maximum size. Rotated files get a numbered suffix, path.1 being the newest,
+// and only maxBackups of them are kept.
+type RotatingFile struct {
+	m          sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+// OpenRotatingFile opens or creates the file at path. A maxSize of 0 disables
+// rotation.
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	rf.f = f
+	rf.size = info.Size()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if p would take it past the
+// maximum size. A single write is never split across files.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.m.Lock()
+	defer rf.m.Unlock()
+
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	// If rotating fails the file keeps growing rather than losing the entry
+	var rotateErr error
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		rotateErr = rf.rotate()
+	}
+
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, errors.Join(rotateErr, err)
+}
+
+// rotate moves the file to the first backup and opens a new one at path. The
+// current file stays open until that succeeds. Errors shifting older backups
+// are returned but don't stop the rotation.
+func (rf *RotatingFile) rotate() error {
+	var errs []error
+	if rf.maxBackups > 0 {
+		if err := os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxBackups)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+		for i := rf.maxBackups - 1; i > 0; i-- {
+			err := os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+		}
+		// The file may already be gone if opening its replacement failed
+		if err := os.Rename(rf.path, rf.path+".1"); err != nil && !os.IsNotExist(err) {
+			return errors.Join(append(errs, err)...)
+		}
+	} else if err := os.Remove(rf.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	old := rf.f
+	if err := rf.open(); err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	if err := old.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.m.Lock()
+	defer rf.m.Unlock()
+
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
@@ -0,0 +1,140 @@
+package dockerauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	a := newTestAuthenticator()
+	a.auditLog = NewAuditLog(&buf)
+
+	store := a.accessControlStore.(*testUserStore)
+	store.acls["test"] = append(store.acls["test"],
+		&AccessControl{IP: "*", Name: "testing/*", Actions: []string{"delete"}},
+		&AccessControl{IP: "10.*", Name: "internal/*", Actions: []string{"pull"}},
+		&AccessControl{IP: "*", Name: "ops/*", Actions: []string{"*"}},
+	)
+
+	r := httptest.NewRequest("GET", "/api/auth?service=localhost:5000"+
+		"&scope=repository:testing/app:pull,push,delete"+
+		"&scope=repository:internal/app:pull"+
+		"&scope=registry:catalog:*"+
+		"&scope=repository:ops/app:*", nil)
+	r.RemoteAddr = "127.0.0.1"
+	token, err := a.GetToken("test", "testing", r)
+	ok(t, err)
+
+	_, err = a.GetToken("test", "wrong", r)
+	equals(t, err, ErrInvalidLogin)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	equals(t, len(lines), 2)
+
+	event := &AuditEvent{}
+	ok(t, json.Unmarshal([]byte(lines[0]), event))
+	equals(t, event.Path, "/api/auth")
+	equals(t, event.Username, "test")
+	equals(t, event.ClientIP, "127.0.0.1")
+	equals(t, event.Service, "localhost:5000")
+	equals(t, event.TokenID, decodeTestToken(t, token).Jti)
+	equals(t, event.Error, "")
+	equals(t, len(event.Scopes), 4)
+
+	equals(t, event.Scopes[0].Scope, "repository:testing/app:pull,push,delete")
+	equals(t, event.Scopes[0].Granted, []string{"pull", "push"})
+	equals(t, event.Scopes[0].Denied, auditDeleteDisabled)
+	equals(t, len(event.Scopes[0].Rules), 2)
+	equals(t, event.Scopes[0].Rules[0], &AuditRule{IP: "*", Repository: "testing/*", Actions: []string{"push", "pull"}})
+
+	equals(t, event.Scopes[1].Granted, []string{})
+	equals(t, event.Scopes[1].Denied, auditIPNotAllowed)
+
+	equals(t, event.Scopes[2].Granted, []string{})
+	equals(t, event.Scopes[2].Denied, auditNoMatchingRule)
+	equals(t, len(event.Scopes[2].Rules), 0)
+
+	// * would include delete
+	equals(t, event.Scopes[3].Granted, []string{"pull", "push"})
+	equals(t, event.Scopes[3].Denied, auditDeleteDisabled)
+
+	event = &AuditEvent{}
+	ok(t, json.Unmarshal([]byte(lines[1]), event))
+	equals(t, event.Error, ErrInvalidLogin.Error())
+	equals(t, event.TokenID, "")
+	equals(t, len(event.Scopes), 0)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	rf, err := OpenRotatingFile(path, 10, 2)
+	ok(t, err)
+	defer rf.Close()
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		_, err := rf.Write([]byte(line))
+		ok(t, err)
+	}
+
+	for file, expected := range map[string]string{
+		path:        "four\nfive\n",
+		path + ".1": "three\n",
+		path + ".2": "one\ntwo\n",
+	} {
+		buf, err := os.ReadFile(file)
+		ok(t, err)
+		equals(t, string(buf), expected)
+	}
+
+	_, err = os.Stat(path + ".3")
+	assert(t, os.IsNotExist(err), "Expected only 2 rotated files")
+
+	// The size of existing files is counted
+	ok(t, rf.Close())
+	rf, err = OpenRotatingFile(path, 10, 2)
+	ok(t, err)
+	_, err = rf.Write([]byte("six\n"))
+	ok(t, err)
+	buf, err := os.ReadFile(path)
+	ok(t, err)
+	equals(t, string(buf), "six\n")
+	buf, err = os.ReadFile(path + ".1")
+	ok(t, err)
+	equals(t, string(buf), "four\nfive\n")
+}
+
+func TestRotatingFileFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	rf, err := OpenRotatingFile(path, 10, 1)
+	ok(t, err)
+	defer rf.Close()
+
+	// A directory in the way of the backup makes rotating fail
+	ok(t, os.MkdirAll(filepath.Join(path+".1", "dir"), 0700))
+
+	_, err = rf.Write([]byte("one\ntwo\n"))
+	ok(t, err)
+	_, err = rf.Write([]byte("three\n"))
+	assert(t, err != nil, "Expected rotation error")
+
+	// Entries are still written and rotation is retried
+	buf, err := os.ReadFile(path)
+	ok(t, err)
+	equals(t, string(buf), "one\ntwo\nthree\n")
+
+	ok(t, os.RemoveAll(path+".1"))
+	_, err = rf.Write([]byte("four\n"))
+	ok(t, err)
+	buf, err = os.ReadFile(path)
+	ok(t, err)
+	equals(t, string(buf), "four\n")
+	buf, err = os.ReadFile(path + ".1")
+	ok(t, err)
+	equals(t, string(buf), "one\ntwo\nthree\n")
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync/atomic"
 )
 
 var (
@@ -15,6 +16,9 @@ var (
 	ErrUnknownService = errors.New("Unknown service")
 )
 
+// anonymousUsername is the token subject of requests without credentials.
+const anonymousUsername = ""
+
 type Logf interface {
 	Print(v ...interface{})
 	Println(v ...interface{})
@@ -38,19 +42,58 @@ type UserAuthenticator interface {
 	Login(username, password string) (bool, error)
 }
 
+// IPUserAuthenticator is implemented by UserAuthenticators which use the
+// client's IP address, such as the LockoutAuthenticator.
+type IPUserAuthenticator interface {
+	LoginFromIP(username, password, ip string) (bool, error)
+}
+
 type AccessControlStore interface {
 	GetACLS(username string) ([]*AccessControl, error)
 }
 
+// GroupProvider is implemented by backends which know the groups a user is a
+// member of. Permissions of configured groups are added to the user's own.
+type GroupProvider interface {
+	GetGroups(username string) ([]string, error)
+}
+
 type Authenticator struct {
+	config             atomic.Pointer[authConfig]
 	userAuthenticator  UserAuthenticator
 	accessControlStore AccessControlStore
+	groupProvider      GroupProvider
+	refreshTokenStore  RefreshTokenStore
+	auditLog           *AuditLog
+	metrics            *metrics
 	log                Logf
 }
 
+// authConfig is the configuration and signing keys of an Authenticator. It's
+// replaced as a whole on reload so each request works with one consistent
+// configuration.
+type authConfig struct {
+	*Config
+	registries     []*registry
+	trustedProxies *ipList
+	proxyHeader    string
+}
+
+// registry is a configured registry along with its signing keys.
+type registry struct {
+	*RegistryConfig
+	keys    *KeySet
+	metrics *metrics
+}
+
 type Options struct {
+	Config             *Config
+	Keys               map[string]*KeySet // Signing keys by registry name, defaults to the keys configured for each registry
 	UserAuthenticator  UserAuthenticator
 	AccessControlStore AccessControlStore
+	GroupProvider      GroupProvider // Defaults to UserAuthenticator or AccessControlStore if either implements GroupProvider
+	RefreshTokenStore  RefreshTokenStore
+	AuditLog           *AuditLog // Token decisions aren't audited if nil
 	Log                Logf
 }
 
@@ -67,15 +110,41 @@ func NewAuthenticator(o *Options) *Authenticator {
 		return nil
 	}
 
+	if o.GroupProvider == nil {
+		if gp, ok := o.UserAuthenticator.(GroupProvider); ok {
+			o.GroupProvider = gp
+		} else if gp, ok := o.AccessControlStore.(GroupProvider); ok {
+			o.GroupProvider = gp
+		}
+	}
+
+	if o.RefreshTokenStore == nil {
+		o.RefreshTokenStore = NewMemoryRefreshTokenStore()
+	}
+
 	if o.Log == nil {
 		o.Log = &nullLogger{}
 	}
 
-	return &Authenticator{
+	a := &Authenticator{
 		userAuthenticator:  o.UserAuthenticator,
 		accessControlStore: o.AccessControlStore,
+		groupProvider:      o.GroupProvider,
+		refreshTokenStore:  o.RefreshTokenStore,
+		auditLog:           o.AuditLog,
+		metrics:            newMetrics(),
 		log:                o.Log,
 	}
+	if err := a.SetConfig(o.Config, o.Keys); err != nil {
+		return nil
+	}
+	return a
+}
+
+// getConfig returns the current configuration. Requests should get it once
+// and use it throughout so a reload doesn't change it half way.
+func (a *Authenticator) getConfig() *authConfig {
+	return a.config.Load()
 }
 
 func (a *Authenticator) GetBasicCredentials(r *http.Request) (string, string) {
@@ -108,67 +177,224 @@ func (a *Authenticator) GetBasicCredentials(r *http.Request) (string, string) {
 	return username, password
 }
 
-func (a *Authenticator) ProcessRequest(w http.ResponseWriter, r *http.Request) error {
+func (a *Authenticator) ProcessRequest(w http.ResponseWriter, r *http.Request) (err error) {
+	c := a.getConfig()
 	username, password := a.GetBasicCredentials(r)
-	token, err := a.GetToken(username, password, r)
+	service := r.URL.Query().Get("service")
+	event := newAuditEvent(c, r, service, username)
+	defer func() { a.recordTokenRequest(event, err) }()
+
+	reg, err := c.getRegistry(service)
+	if err != nil {
+		return err
+	}
+
+	token, claims, err := a.getToken(c, reg, event, username, password, r)
 	if err != nil {
 		return err
 	}
-	if config.PrintToken {
+	if c.PrintToken {
 		a.log.Printf("Granting token: %s\n", token)
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf(`{"token": "%s"}`, token)))
-	return nil
+
+	resp := newTokenResponse(token, claims)
+	resp.Token = token
+
+	if r.URL.Query().Get("offline_token") == "true" && username != anonymousUsername {
+		clientID := r.URL.Query().Get("client_id")
+		a.log.Printf("Issuing refresh token: client_id=%s, user=%s\n", clientID, username)
+		resp.RefreshToken, err = generateRefreshToken(reg, username, clientID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeTokenResponse(w, resp)
 }
 
-func (a *Authenticator) GetToken(username, password string, r *http.Request) (string, error) {
+func (a *Authenticator) GetToken(username, password string, r *http.Request) (token string, err error) {
+	c := a.getConfig()
 	service := r.URL.Query().Get("service")
-	if service != config.Registry.Name {
-		return "", ErrUnknownService
-	}
+	event := newAuditEvent(c, r, service, username)
+	defer func() { a.recordTokenRequest(event, err) }()
 
-	ok, err := a.userAuthenticator.Login(username, password)
+	reg, err := c.getRegistry(service)
 	if err != nil {
 		return "", err
 	}
-	if !ok {
-		return "", ErrInvalidLogin
+
+	token, _, err = a.getToken(c, reg, event, username, password, r)
+	return token, err
+}
+
+// getToken authenticates the user and issues a token for the scopes they're
+// allowed, recording the decision in event.
+func (a *Authenticator) getToken(c *authConfig, reg *registry, event *AuditEvent, username, password string, r *http.Request) (string, *jwtPayload, error) {
+	if err := a.login(c, reg, username, password, r); err != nil {
+		return "", nil, err
 	}
 
-	scope := r.URL.Query().Get("scope")
+	access, err := a.authorizeScopes(c, reg, event, username, r.URL.Query()["scope"], r)
+	if err != nil {
+		return "", nil, err
+	}
 
-	// No scope, empty access
-	if scope == "" {
-		return GenerateToken(username, make([]*AccessControl, 0))
+	ttl, err := a.tokenTTL(reg, username, access)
+	if err != nil {
+		return "", nil, err
 	}
 
-	req := parseScope(scope)
-	if req == nil {
-		return "", ErrInvalidScope
+	token, claims, err := generateToken(reg, username, access, ttl)
+	if err != nil {
+		return "", nil, err
 	}
+	event.TokenID = claims.Jti
+	return token, claims, nil
+}
 
-	a.log.Printf("Scope: Type: %s, Name: %s, Actions: %s\n", req.Type, req.Name, strings.Join(req.Actions, ","))
+// login checks the user's credentials. Requests without an Authorization
+// header are logged in as the anonymous user if it's enabled, requests with
+// invalid credentials are always rejected.
+func (a *Authenticator) login(c *authConfig, reg *registry, username, password string, r *http.Request) error {
+	if reg.isAnonymous(username, password, r) {
+		a.log.Println("Anonymous request")
+		return nil
+	}
 
-	// No actions asked, return request
-	if len(req.Actions) == 0 {
-		return GenerateToken(username, []*AccessControl{req})
+	ok, err := a.userLogin(username, password, c.clientIP(r))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidLogin
+	}
+	return nil
+}
+
+func (reg *registry) isAnonymous(username, password string, r *http.Request) bool {
+	return reg.Anonymous.Enabled &&
+		username == anonymousUsername && password == "" &&
+		r.Header.Get("Authorization") == ""
+}
+
+// getACLS returns the ACLs of username and their groups which apply to reg or
+// the registry's anonymous ACLs.
+func (a *Authenticator) getACLS(c *authConfig, reg *registry, username string) ([]*AccessControl, error) {
+	if username == anonymousUsername {
+		return reg.Anonymous.Permissions, nil
 	}
 
 	acls, err := a.accessControlStore.GetACLS(username)
 	if err != nil {
-		return "", err
+		return nil, a.groupLookupError(username, err)
 	}
 
-	acls = a.filterRepository(acls, req.Name)
+	if a.groupProvider != nil && len(c.Group) > 0 {
+		groups, err := a.groupProvider.GetGroups(username)
+		if err != nil {
+			return nil, a.groupLookupError(username, err)
+		}
 
-	if !a.checkIPAddress(r, acls) {
-		return GenerateToken(username, make([]*AccessControl, 0))
+		// Copy so the store's slice isn't appended to
+		acls = append(append([]*AccessControl{}, acls...), groupACLs(c.Group, groups)...)
 	}
+	return filterService(acls, reg.Name), nil
+}
 
-	resp := a.compareACLS(acls, req)
+// groupLookupError turns errors from a store which only knows a user's groups
+// for a while after they logged in with their password into a failed login.
+// The user's cached credentials are forgotten so logging in again refreshes
+// their groups.
+func (a *Authenticator) groupLookupError(username string, err error) error {
+	if errors.Is(err, ErrLDAPNoGroupInfo) {
+		a.ForgetCredentials(username)
+		return ErrInvalidLogin
+	}
+	return err
+}
 
-	a.log.Printf("Granting actions: %s\n", strings.Join(resp.Actions, ","))
+// getRegistry returns the registry named service.
+func (c *authConfig) getRegistry(service string) (*registry, error) {
+	for _, reg := range c.registries {
+		if reg.Name == service {
+			return reg, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownService, service)
+}
+
+// requestRegistry returns the registry named by the request's service
+// parameter, or the first registry if the request doesn't name one.
+func (c *authConfig) requestRegistry(r *http.Request) (*registry, error) {
+	service := r.URL.Query().Get("service")
+	if service == "" {
+		return c.registries[0], nil
+	}
+	return c.getRegistry(service)
+}
+
+// authorizeScopes evaluates each requested scope against the user's ACLs and
+// returns the access claims to place in the token. The decision on each scope
+// is added to event.
+func (a *Authenticator) authorizeScopes(c *authConfig, reg *registry, event *AuditEvent, username string, scopes []string, r *http.Request) ([]*AccessControl, error) {
+	var acls []*AccessControl
+	var err error
+	access := make([]*AccessControl, 0, len(scopes))
+	for _, scope := range scopes {
+		// Empty scopes, such as from "scope=", ask for nothing
+		if scope == "" {
+			continue
+		}
+
+		req := parseScope(scope)
+		if req == nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidScope, scope)
+		}
+
+		a.log.Printf("Scope: Type: %s, Name: %s, Actions: %s\n", req.Type, req.Name, strings.Join(req.Actions, ","))
+
+		// No actions asked, return request
+		if len(req.Actions) == 0 {
+			event.Scopes = append(event.Scopes, &AuditScope{Scope: scope, Granted: []string{}})
+			access = append(access, req)
+			continue
+		}
+
+		if acls == nil {
+			acls, err = a.getACLS(c, reg, username)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		repoACLs := a.filterRepository(a.filterType(acls, req.Type), req.Name)
+		decision := &AuditScope{Scope: scope, Granted: []string{}, Rules: newAuditRules(repoACLs)}
+		event.Scopes = append(event.Scopes, decision)
+
+		if !a.checkIPAddress(event.ClientIP, repoACLs) {
+			decision.Denied = auditIPNotAllowed
+			continue
+		}
+
+		resp := a.compareACLS(repoACLs, req)
+		permitted := newActionList(resp.Actions)
+		resp = reg.applyRegistryPolicy(resp)
+		granted := newActionList(resp.Actions)
+
+		a.log.Printf("Granting actions: %s\n", strings.Join(resp.Actions, ","))
+
+		decision.Granted = resp.Actions
+		switch {
+		case permitted["delete"] && !granted["delete"], permitted["*"] && !granted["*"]:
+			decision.Denied = auditDeleteDisabled
+		case len(resp.Actions) < len(newActionList(req.Actions)) && len(repoACLs) == 0:
+			decision.Denied = auditNoMatchingRule
+		case len(resp.Actions) < len(newActionList(req.Actions)):
+			decision.Denied = auditNotPermitted
+		}
+
+		access = append(access, resp)
+	}
 
-	return GenerateToken(username, []*AccessControl{resp})
+	return access, nil
 }
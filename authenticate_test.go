@@ -0,0 +1,252 @@
+package dockerauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testUserStore struct {
+	users map[string]string
+	acls  map[string][]*AccessControl
+}
+
+func (s *testUserStore) Login(username, password string) (bool, error) {
+	p, exists := s.users[username]
+	return exists && p == password, nil
+}
+
+func (s *testUserStore) GetACLS(username string) ([]*AccessControl, error) {
+	if _, exists := s.users[username]; !exists {
+		return nil, ErrUserNotFound
+	}
+	return s.acls[username], nil
+}
+
+func newTestConfig() *Config {
+	c := &Config{
+		Registry: RegistryList{{Name: "localhost:5000"}},
+	}
+	c.Registry[0].Auth.Key = "testdata/auth.key"
+	c.Registry[0].Auth.Issuer = "test-issuer"
+	return c
+}
+
+// testRegistry returns the first configured registry of a.
+func testRegistry(a *Authenticator) *registry {
+	return a.getConfig().registries[0]
+}
+
+func newTestAuthenticator() *Authenticator {
+	store := &testUserStore{
+		users: map[string]string{"test": "testing"},
+		acls: map[string][]*AccessControl{
+			"test": {
+				{IP: "*", Name: "testing/*", Actions: []string{"push", "pull"}},
+				{IP: "*", Name: "*", Actions: []string{"pull"}},
+			},
+		},
+	}
+
+	return NewAuthenticator(&Options{
+		Config:             newTestConfig(),
+		UserAuthenticator:  store,
+		AccessControlStore: store,
+	})
+}
+
+func decodeTestToken(t *testing.T, token string) *jwtPayload {
+	parts := strings.Split(token, ".")
+	assert(t, len(parts) == 3, "Token has %d parts, expected 3", len(parts))
+
+	buf, err := base64.RawURLEncoding.DecodeString(parts[1])
+	ok(t, err)
+
+	payload := &jwtPayload{}
+	ok(t, json.Unmarshal(buf, payload))
+	return payload
+}
+
+func TestGetTokenMultipleScopes(t *testing.T) {
+	a := newTestAuthenticator()
+
+	r, _ := http.NewRequest("GET", "/api/auth?service=localhost:5000"+
+		"&scope=repository:alpine:pull"+
+		"&scope=repository:testing/app:push,pull", nil)
+	r.RemoteAddr = "127.0.0.1"
+
+	token, err := a.GetToken("test", "testing", r)
+	ok(t, err)
+
+	payload := decodeTestToken(t, token)
+	equals(t, payload.Access, []*AccessControl{
+		{Type: "repository", Name: "alpine", Actions: []string{"pull"}},
+		{Type: "repository", Name: "testing/app", Actions: []string{"pull", "push"}},
+	})
+}
+
+func TestGetTokenInvalidScope(t *testing.T) {
+	a := newTestAuthenticator()
+
+	r, _ := http.NewRequest("GET", "/api/auth?service=localhost:5000"+
+		"&scope=repository:alpine:pull"+
+		"&scope=repository", nil)
+
+	_, err := a.GetToken("test", "testing", r)
+	assert(t, errors.Is(err, ErrInvalidScope), "Expected invalid scope, got %v", err)
+
+	// Empty scopes are ignored
+	r, _ = http.NewRequest("GET", "/api/auth?service=localhost:5000&scope=", nil)
+	token, err := a.GetToken("test", "testing", r)
+	ok(t, err)
+	equals(t, len(decodeTestToken(t, token).Access), 0)
+}
+
+func TestProcessRequestResponse(t *testing.T) {
+	a := newTestAuthenticator()
+
+	r, _ := http.NewRequest("GET", "/api/auth?service=localhost:5000&scope=repository:alpine:pull", nil)
+	r.SetBasicAuth("test", "testing")
+	r.RemoteAddr = "127.0.0.1"
+	w := httptest.NewRecorder()
+
+	ok(t, a.ProcessRequest(w, r))
+	equals(t, w.Code, http.StatusOK)
+	equals(t, w.Header().Get("Content-Type"), "application/json")
+
+	resp := &tokenResponse{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), resp))
+	equals(t, resp.Token, resp.AccessToken)
+	equals(t, resp.RefreshToken, "")
+
+	payload := decodeTestToken(t, resp.Token)
+	equals(t, resp.ExpiresIn, payload.Exp-payload.Iat)
+
+	issued, err := time.Parse(time.RFC3339, resp.IssuedAt)
+	ok(t, err)
+	equals(t, issued.Unix(), payload.Iat)
+}
+
+func TestIndependentAuthenticators(t *testing.T) {
+	a := newTestAuthenticator()
+	b := newTestAuthenticator()
+	testRegistry(b).Name = "staging:5000"
+
+	req := httptest.NewRequest("GET", "/api/auth?service=localhost:5000", nil)
+	_, err := a.GetToken("test", "testing", req)
+	ok(t, err)
+	_, err = b.GetToken("test", "testing", req)
+	assert(t, errors.Is(err, ErrUnknownService), "Expected unknown service, got %v", err)
+}
+
+func TestMultipleRegistries(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ok(t, err)
+
+	config := newTestConfig()
+	staging := &RegistryConfig{Name: "staging:5000", AllowDelete: true}
+	staging.Auth.Key = writeTestKey(t, key)
+	staging.Auth.Issuer = "staging-issuer"
+	staging.Auth.TokenTTL = Duration{8 * time.Hour}
+	config.Registry = append(config.Registry, staging)
+
+	store := &testUserStore{
+		users: map[string]string{"test": "testing"},
+		acls: map[string][]*AccessControl{
+			"test": {
+				{IP: "*", Name: "testing/*", Actions: []string{"pull"}},
+				{IP: "*", Service: "staging:5000", Name: "**", Actions: []string{"pull", "delete"}},
+			},
+		},
+	}
+	a := NewAuthenticator(&Options{
+		Config:             config,
+		UserAuthenticator:  store,
+		AccessControlStore: store,
+	})
+	local, err := a.getConfig().getRegistry("localhost:5000")
+	ok(t, err)
+	stage, err := a.getConfig().getRegistry("staging:5000")
+	ok(t, err)
+
+	r := httptest.NewRequest("GET", "/api/auth?service=localhost:5000&scope=repository:prod/app:pull,delete", nil)
+	token, err := a.GetToken("test", "testing", r)
+	ok(t, err)
+	payload := &jwtPayload{}
+	ok(t, decodeJWT(token, payload, local.keys))
+	equals(t, payload.Iss, "test-issuer")
+	equals(t, payload.Access[0].Actions, []string{})
+
+	r = httptest.NewRequest("GET", "/api/auth?service=staging:5000&scope=repository:prod/app:pull,delete", nil)
+	token, err = a.GetToken("test", "testing", r)
+	ok(t, err)
+	assert(t, decodeJWT(token, &jwtPayload{}, local.keys) != nil, "Staging token verified with the local keys")
+	payload = &jwtPayload{}
+	ok(t, decodeJWT(token, payload, stage.keys))
+	equals(t, payload.Iss, "staging-issuer")
+	equals(t, payload.Aud, "staging:5000")
+	equals(t, payload.Exp-payload.Iat, int64(8*time.Hour/time.Second))
+	equals(t, payload.Access[0].Actions, []string{"pull", "delete"})
+
+	// Refresh tokens are only valid for the registry they were issued for
+	refreshToken, err := a.GenerateRefreshToken("staging:5000", "test", "test-client")
+	ok(t, err)
+	_, err = a.validateRefreshToken(local, refreshToken)
+	equals(t, err, ErrInvalidRefreshToken)
+	username, err := a.validateRefreshToken(stage, refreshToken)
+	ok(t, err)
+	equals(t, username, "test")
+	ok(t, a.RevokeRefreshToken(refreshToken))
+
+	_, err = a.GenerateToken("production:5000", "test", nil)
+	assert(t, errors.Is(err, ErrUnknownService), "Expected unknown service, got %v", err)
+}
+
+func TestGetTokenAnonymous(t *testing.T) {
+	a := newTestAuthenticator()
+	reg := testRegistry(a)
+	reg.Anonymous.Enabled = true
+	reg.Anonymous.Permissions = []*AccessControl{
+		{IP: "*", Name: "public/**", Actions: []string{"pull"}},
+	}
+
+	r, _ := http.NewRequest("GET", "/api/auth?service=localhost:5000"+
+		"&scope=repository:public/alpine:pull,push"+
+		"&scope=repository:testing/app:pull", nil)
+	r.RemoteAddr = "127.0.0.1"
+
+	token, err := a.GetToken("", "", r)
+	ok(t, err)
+
+	payload := decodeTestToken(t, token)
+	equals(t, payload.Sub, "")
+	equals(t, payload.Access, []*AccessControl{
+		{Type: "repository", Name: "public/alpine", Actions: []string{"pull"}},
+		{Type: "repository", Name: "testing/app", Actions: []string{}},
+	})
+
+	// Wrong credentials aren't downgraded to anonymous
+	r.SetBasicAuth("test", "wrong")
+	_, err = a.GetToken("test", "wrong", r)
+	equals(t, err, ErrInvalidLogin)
+
+	// Credentials that can't be parsed aren't either
+	r.Header.Set("Authorization", "Basic !!!")
+	username, password := a.GetBasicCredentials(r)
+	_, err = a.GetToken(username, password, r)
+	equals(t, err, ErrInvalidLogin)
+
+	// Disabled
+	reg.Anonymous.Enabled = false
+	r.Header.Del("Authorization")
+	_, err = a.GetToken("", "", r)
+	equals(t, err, ErrInvalidLogin)
+}
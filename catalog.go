@@ -0,0 +1,174 @@
+package dockerauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CatalogPath = "/v2/_catalog"
+
+	catalogPageSize = 1000
+)
+
+var (
+	ErrCatalogUnavailable = errors.New("Registry catalog unavailable")
+
+	catalogClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+type catalogResponse struct {
+	Repositories []string `json:"repositories"`
+}
+
+// ProcessCatalogRequest serves the registry catalog filtered to the
+// repositories the user can pull. The full catalog is fetched from the
+// registry using a token granting registry:catalog:*. The registry is chosen
+// with the service parameter, the first registry is used without it.
+func (a *Authenticator) ProcessCatalogRequest(w http.ResponseWriter, r *http.Request) error {
+	c := a.getConfig()
+	reg, err := c.requestRegistry(r)
+	if err != nil {
+		return err
+	}
+
+	username, password := a.GetBasicCredentials(r)
+	if err := a.login(c, reg, username, password, r); err != nil {
+		return err
+	}
+
+	repos, err := fetchCatalog(reg)
+	if err != nil {
+		return err
+	}
+
+	acls, err := a.getACLS(c, reg, username)
+	if err != nil {
+		return err
+	}
+
+	repos = a.filterCatalog(acls, repos, c.clientIP(r))
+
+	// Paginate the same as the registry
+	if last := r.URL.Query().Get("last"); last != "" {
+		i := sort.SearchStrings(repos, last)
+		if i < len(repos) && repos[i] == last {
+			i++
+		}
+		repos = repos[i:]
+	}
+
+	if n, err := strconv.Atoi(r.URL.Query().Get("n")); err == nil && n >= 0 && n < len(repos) {
+		repos = repos[:n]
+		if n > 0 {
+			next := url.Values{}
+			if service := r.URL.Query().Get("service"); service != "" {
+				next.Set("service", service)
+			}
+			next.Set("n", strconv.Itoa(n))
+			next.Set("last", repos[n-1])
+			w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, CatalogPath, next.Encode()))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	return json.NewEncoder(w).Encode(&catalogResponse{Repositories: repos})
+}
+
+// filterCatalog returns the sorted list of repositories the user can pull.
+func (a *Authenticator) filterCatalog(acls []*AccessControl, repos []string, clientIP string) []string {
+	acls = a.filterType(acls, "repository")
+	filtered := make([]string, 0, len(repos))
+
+	for _, repo := range repos {
+		repoACLs := a.filterRepository(acls, repo)
+		if !a.checkIPAddress(clientIP, repoACLs) {
+			continue
+		}
+
+		resp := a.compareACLS(repoACLs, &AccessControl{Actions: []string{"pull"}})
+		if len(resp.Actions) > 0 {
+			filtered = append(filtered, repo)
+		}
+	}
+
+	sort.Strings(filtered)
+	return filtered
+}
+
+// fetchCatalog retrieves every repository in the registry following the
+// registry's pagination links. Failures talking to the registry are
+// ErrCatalogUnavailable.
+func fetchCatalog(reg *registry) ([]string, error) {
+	token, _, err := generateToken(reg, reg.Auth.Issuer, []*AccessControl{
+		{Type: "registry", Name: "catalog", Actions: []string{"*"}},
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	next, err := url.Parse(strings.TrimRight(reg.Address, "/") + "/_catalog?n=" + strconv.Itoa(catalogPageSize))
+	if err != nil {
+		return nil, err
+	}
+
+	var repos []string
+	for next != nil {
+		req, err := http.NewRequest("GET", next.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := catalogClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrCatalogUnavailable, err)
+		}
+
+		page := &catalogResponse{}
+		err = json.NewDecoder(resp.Body).Decode(page)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%w: %s", ErrCatalogUnavailable, resp.Status)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrCatalogUnavailable, err)
+		}
+		repos = append(repos, page.Repositories...)
+
+		next, err = nextCatalogPage(next, resp.Header.Get("Link"))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrCatalogUnavailable, err)
+		}
+	}
+	return repos, nil
+}
+
+// nextCatalogPage parses a Link header of the form `</v2/_catalog?last=a&n=1>;
+// rel="next"` relative to the current page URL. It returns nil when there are
+// no more pages.
+func nextCatalogPage(current *url.URL, link string) (*url.URL, error) {
+	if link == "" {
+		return nil, nil
+	}
+
+	start := strings.Index(link, "<")
+	end := strings.Index(link, ">")
+	if start == -1 || end < start || !strings.Contains(link[end:], `rel="next"`) {
+		return nil, nil
+	}
+
+	ref, err := url.Parse(link[start+1 : end])
+	if err != nil {
+		return nil, err
+	}
+	return current.ResolveReference(ref), nil
+}
@@ -0,0 +1,104 @@
+package dockerauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestRegistry(t *testing.T, repos []string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		equals(t, r.URL.Path, "/v2/_catalog")
+
+		auth := r.Header.Get("Authorization")
+		assert(t, strings.HasPrefix(auth, "Bearer "), "Missing bearer token: %s", auth)
+		payload := decodeTestToken(t, strings.TrimPrefix(auth, "Bearer "))
+		equals(t, payload.Access, []*AccessControl{
+			{Type: "registry", Name: "catalog", Actions: []string{"*"}},
+		})
+
+		// Return two repositories per page
+		page := repos
+		if r.URL.Query().Get("last") != "" {
+			for i, repo := range repos {
+				if repo == r.URL.Query().Get("last") {
+					page = repos[i+1:]
+				}
+			}
+		}
+		if len(page) > 2 {
+			page = page[:2]
+			w.Header().Set("Link", fmt.Sprintf(`</v2/_catalog?last=%s&n=2>; rel="next"`, page[1]))
+		}
+
+		json.NewEncoder(w).Encode(&catalogResponse{Repositories: page})
+	}))
+}
+
+func TestCatalogProxy(t *testing.T) {
+	a := newTestAuthenticator()
+
+	registry := newTestRegistry(t, []string{"alpine", "private/app", "testing/app", "testing/db", "ubuntu"})
+	defer registry.Close()
+	testRegistry(a).Address = registry.URL + "/v2"
+
+	r, _ := http.NewRequest("GET", CatalogPath, nil)
+	r.SetBasicAuth("test", "testing")
+	r.RemoteAddr = "127.0.0.1"
+	w := httptest.NewRecorder()
+
+	ok(t, a.ProcessCatalogRequest(w, r))
+
+	resp := &catalogResponse{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), resp))
+	equals(t, resp.Repositories, []string{"alpine", "testing/app", "testing/db", "ubuntu"})
+
+	// Paginated
+	r, _ = http.NewRequest("GET", CatalogPath+"?n=2&last=alpine", nil)
+	r.SetBasicAuth("test", "testing")
+	r.RemoteAddr = "127.0.0.1"
+	w = httptest.NewRecorder()
+
+	ok(t, a.ProcessCatalogRequest(w, r))
+	ok(t, json.Unmarshal(w.Body.Bytes(), resp))
+	equals(t, resp.Repositories, []string{"testing/app", "testing/db"})
+	equals(t, w.Header().Get("Link"), `</v2/_catalog?last=testing%2Fdb&n=2>; rel="next"`)
+
+	// Bad login
+	r.SetBasicAuth("test", "wrong")
+	equals(t, a.ProcessCatalogRequest(httptest.NewRecorder(), r), ErrInvalidLogin)
+
+	// Registry down
+	registry.Close()
+	r.SetBasicAuth("test", "testing")
+	err := a.ProcessCatalogRequest(httptest.NewRecorder(), r)
+	assert(t, errors.Is(err, ErrCatalogUnavailable), "Expected catalog unavailable, got %v", err)
+}
+
+func TestCatalogScope(t *testing.T) {
+	a := newTestAuthenticator()
+	store := a.accessControlStore.(*testUserStore)
+
+	r, _ := http.NewRequest("GET", "/api/auth?service=localhost:5000&scope=registry:catalog:*", nil)
+	r.RemoteAddr = "127.0.0.1"
+
+	// Repository rules don't grant catalog access
+	token, err := a.GetToken("test", "testing", r)
+	ok(t, err)
+	equals(t, decodeTestToken(t, token).Access, []*AccessControl{
+		{Type: "registry", Name: "catalog", Actions: []string{}},
+	})
+
+	store.acls["test"] = append(store.acls["test"],
+		&AccessControl{IP: "*", Type: "registry", Name: "catalog", Actions: []string{"*"}})
+
+	token, err = a.GetToken("test", "testing", r)
+	ok(t, err)
+	equals(t, decodeTestToken(t, token).Access, []*AccessControl{
+		{Type: "registry", Name: "catalog", Actions: []string{"*"}},
+	})
+}
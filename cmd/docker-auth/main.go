@@ -1,49 +1,249 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	auth "github.com/lfkeitel/docker-registry-auth"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 var (
 	addr     string
 	config   string
 	accounts string
+	watch    time.Duration
 )
 
 func init() {
 	flag.StringVar(&addr, "addr", ":8080", "Network address to use")
 	flag.StringVar(&config, "config", "config.toml", "Configuration file")
 	flag.StringVar(&accounts, "accounts", "accounts.toml", "Accounts file")
+	flag.DurationVar(&watch, "watch", 0, "Reload the configuration and accounts files when they change, checking at this interval")
 }
 
 func main() {
 	flag.Parse()
 
-	if err := auth.LoadConfig(config); err != nil {
+	c, err := auth.LoadConfig(config)
+	if err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
 	}
 
-	http.HandleFunc("/api/auth", authHandlerFactory())
+	keys := make(map[string]*auth.KeySet, len(c.Registry))
+	for _, r := range c.Registry {
+		ks, err := auth.LoadRegistryKeys(r)
+		if err != nil {
+			fmt.Printf("Registry %s: %s\n", r.Name, err)
+			os.Exit(1)
+		}
+		keys[r.Name] = ks
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "certbundle":
+		printCertBundle(c, keys, flag.Arg(1))
+		return
+	case "migrate":
+		migrateSQL(c)
+		return
+	default:
+		fmt.Printf("Unknown command %s\n", flag.Arg(0))
+		os.Exit(1)
+	}
+
+	authenticator, store := newAuthenticator(c, keys)
+	handleReloads(authenticator, store)
+
+	http.HandleFunc("/api/auth", authHandlerFactory(authenticator))
+	http.HandleFunc("/token", oauthHandlerFactory(authenticator))
+	http.HandleFunc("/token/revoke", revokeHandlerFactory(authenticator))
+	http.HandleFunc(auth.CatalogPath, catalogHandlerFactory(authenticator))
+	http.HandleFunc(auth.JWKSPath, keysHandlerFactory(authenticator.ProcessJWKSRequest))
+	http.HandleFunc(auth.DiscoveryPath, keysHandlerFactory(authenticator.ProcessDiscoveryRequest))
+
+	// Handlers with their own address, listeners are shared by address
+	muxes := make(map[string]*http.ServeMux)
+	if admin := c.Admin; admin != nil && admin.Enabled {
+		handle(muxes, admin.Addr, auth.AdminPath, adminHandlerFactory(authenticator))
+	}
+	if metrics := c.Metrics; metrics != nil && metrics.Enabled {
+		handle(muxes, metrics.Addr, auth.MetricsPath, keysHandlerFactory(authenticator.ProcessMetricsRequest))
+	}
+	for addr, mux := range muxes {
+		go func(addr string, mux *http.ServeMux) {
+			fmt.Println(http.ListenAndServe(addr, mux))
+			os.Exit(1)
+		}(addr, mux)
+	}
+
 	http.ListenAndServe(addr, nil)
 }
 
-func authHandlerFactory() http.HandlerFunc {
-	fa, err := auth.NewFileAuthenticator(accounts)
+// handle registers handler at path on the mux for addr, or on the main
+// listener if addr is empty.
+func handle(muxes map[string]*http.ServeMux, addr, path string, handler http.HandlerFunc) {
+	if addr == "" {
+		http.HandleFunc(path, handler)
+		return
+	}
+
+	if muxes[addr] == nil {
+		muxes[addr] = http.NewServeMux()
+	}
+	muxes[addr].HandleFunc(path, handler)
+}
+
+// printCertBundle writes the certificates of all signing keys of the named
+// registry, or the first registry, for use as the registry's rootcertbundle.
+func printCertBundle(c *auth.Config, keys map[string]*auth.KeySet, name string) {
+	if name == "" {
+		name = c.Registry[0].Name
+	}
+
+	ks, exists := keys[name]
+	if !exists {
+		fmt.Printf("Unknown registry %s\n", name)
+		os.Exit(1)
+	}
+
+	bundle, err := ks.CertBundle()
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	os.Stdout.Write(bundle)
+}
 
+// migrateSQL creates or updates the schema of the SQL backend's database.
+func migrateSQL(c *auth.Config) {
+	if c.SQL == nil {
+		fmt.Println("migrate requires an [sql] section")
+		os.Exit(1)
+	}
+
+	from, to, err := auth.MigrateSQL(c.SQL)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if from == to {
+		fmt.Printf("Schema is up to date at version %d\n", to)
+		return
+	}
+	fmt.Printf("Migrated schema from version %d to %d\n", from, to)
+}
+
+// handleReloads reloads the configuration and the store's data on SIGHUP and,
+// if enabled, when the files change.
+func handleReloads(authenticator *auth.Authenticator, store auth.AccessControlStore) {
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+
+	if watch > 0 {
+		files := []string{config}
+		if _, ok := store.(*auth.FileAuthenticator); ok {
+			files = append(files, accounts)
+		}
+		auth.WatchFiles(watch, files, func() {
+			reloads <- syscall.SIGHUP
+		})
+	}
+
+	go func() {
+		for range reloads {
+			reload(authenticator, store)
+		}
+	}()
+}
+
+func reload(authenticator *auth.Authenticator, store auth.AccessControlStore) {
+	if err := authenticator.ReloadConfig(config); err != nil {
+		fmt.Printf("Reloading %s failed, keeping the current configuration: %s\n", config, err)
+	} else {
+		fmt.Printf("Reloaded %s\n", config)
+	}
+
+	if r, ok := store.(auth.Reloader); ok {
+		if err := r.Reload(); err != nil {
+			fmt.Printf("Reloading users failed, keeping the current users: %s\n", err)
+		} else {
+			fmt.Println("Reloaded users")
+		}
+	}
+	authenticator.FlushCredentials()
+}
+
+func newAuthenticator(c *auth.Config, keys map[string]*auth.KeySet) (*auth.Authenticator, auth.AccessControlStore) {
 	o := &auth.Options{
-		UserAuthenticator:  fa,
-		AccessControlStore: fa,
-		Log:                &simpleLogger{},
+		Config: c,
+		Keys:   keys,
+		Log:    &simpleLogger{},
+	}
+
+	if c.Audit != nil && c.Audit.Enabled {
+		o.AuditLog = newAuditLog(c.Audit)
+	}
+
+	switch c.Backend {
+	case "", "file":
+		fa, err := auth.NewFileAuthenticator(accounts)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		o.UserAuthenticator = fa
+		o.AccessControlStore = fa
+	case "ldap":
+		if c.LDAP == nil {
+			fmt.Println("LDAP backend requires an [ldap] section")
+			os.Exit(1)
+		}
+		la, err := auth.NewLDAPAuthenticator(c.LDAP)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		o.UserAuthenticator = la
+		o.AccessControlStore = la
+	case "sql":
+		if c.SQL == nil {
+			fmt.Println("SQL backend requires an [sql] section")
+			os.Exit(1)
+		}
+		sa, err := auth.NewSQLAuthenticator(c.SQL)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		o.UserAuthenticator = sa
+		o.AccessControlStore = sa
+	default:
+		fmt.Printf("Unknown backend %s\n", c.Backend)
+		os.Exit(1)
+	}
+
+	if c.Lockout != nil && c.Lockout.Enabled {
+		o.UserAuthenticator = auth.NewLockoutAuthenticator(o.UserAuthenticator, c.Lockout)
+	}
+	// Cached logins skip the lockout, they were verified within the TTL
+	if c.Cache != nil && c.Cache.Enabled {
+		ca, err := auth.NewCachingAuthenticator(o.UserAuthenticator, c.Cache.TTL.Duration)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		o.UserAuthenticator = ca
 	}
 
 	authenticator := auth.NewAuthenticator(o)
@@ -51,12 +251,112 @@ func authHandlerFactory() http.HandlerFunc {
 		fmt.Println("FIX ME")
 		os.Exit(1)
 	}
+	return authenticator, o.AccessControlStore
+}
+
+// newAuditLog opens the configured audit log sink.
+func newAuditLog(c *auth.AuditConfig) *auth.AuditLog {
+	if c.File == "" || c.File == "-" {
+		return auth.NewAuditLog(os.Stdout)
+	}
+
+	f, err := auth.OpenRotatingFile(c.File, int64(c.MaxSize)*1024*1024, c.MaxBackups)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return auth.NewAuditLog(f)
+}
 
+func authHandlerFactory(authenticator *auth.Authenticator) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("Request: %s\n", r.URL.String())
 		if err := authenticator.ProcessRequest(w, r); err != nil {
 			fmt.Println(err)
-			w.WriteHeader(http.StatusUnauthorized)
+			auth.WriteError(w, err)
+			return
+		}
+	}
+}
+
+func oauthHandlerFactory(authenticator *auth.Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Printf("OAuth request: %s\n", r.URL.String())
+		if err := authenticator.ProcessOAuthRequest(w, r); err != nil {
+			fmt.Println(err)
+			auth.WriteError(w, err)
+			return
+		}
+	}
+}
+
+func revokeHandlerFactory(authenticator *auth.Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := authenticator.ProcessRevokeRequest(w, r); err != nil {
+			fmt.Println(err)
+			auth.WriteError(w, err)
+			return
+		}
+	}
+}
+
+func catalogHandlerFactory(authenticator *auth.Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Printf("Catalog request: %s\n", r.URL.String())
+		if err := authenticator.ProcessCatalogRequest(w, r); err != nil {
+			fmt.Println(err)
+			auth.WriteError(w, err)
+			return
+		}
+	}
+}
+
+func adminHandlerFactory(authenticator *auth.Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Printf("Admin request: %s %s\n", r.Method, r.URL.String())
+		if err := authenticator.ProcessAdminRequest(w, r); err != nil {
+			fmt.Println(err)
+			switch {
+			case errors.Is(err, auth.ErrTooManyAttempts):
+				http.Error(w, err.Error(), loginFailedStatus(w, err, http.StatusTooManyRequests))
+			case errors.Is(err, auth.ErrInvalidLogin):
+				w.Header().Set("WWW-Authenticate", `Basic realm="Admin API"`)
+				http.Error(w, err.Error(), loginFailedStatus(w, err, http.StatusUnauthorized))
+			case errors.Is(err, auth.ErrForbidden):
+				http.Error(w, err.Error(), http.StatusForbidden)
+			case errors.Is(err, auth.ErrNotFound), errors.Is(err, auth.ErrUserNotFound):
+				http.Error(w, err.Error(), http.StatusNotFound)
+			case errors.Is(err, auth.ErrMethodNotAllowed):
+				http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+			case errors.Is(err, auth.ErrUserExists):
+				http.Error(w, err.Error(), http.StatusConflict)
+			case errors.Is(err, auth.ErrInvalidRequest):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			case errors.Is(err, auth.ErrStoreReadOnly):
+				http.Error(w, err.Error(), http.StatusNotImplemented)
+			default:
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+}
+
+// loginFailedStatus sets the Retry-After header if err is from a lockout and
+// returns the status for it, 429 while logins are refused and otherwise
+// status.
+func loginFailedStatus(w http.ResponseWriter, err error, status int) int {
+	if auth.SetRetryAfter(w, err) && errors.Is(err, auth.ErrTooManyAttempts) {
+		return http.StatusTooManyRequests
+	}
+	return status
+}
+
+func keysHandlerFactory(process func(http.ResponseWriter, *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := process(w, r); err != nil {
+			fmt.Println(err)
+			auth.WriteError(w, err)
 			return
 		}
 	}
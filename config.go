@@ -2,32 +2,142 @@ package dockerauth
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/naoina/toml"
 )
 
-var (
-	config *Config
+const (
+	defaultTokenTTL        = time.Hour
+	defaultClockSkew       = 30 * time.Second
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
 )
 
+// Duration is a time.Duration read from a string such as "1h30m".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
 type Config struct {
-	PrintToken bool
-	Registry   *RegistryConfig
+	PrintToken         bool
+	Backend            string
+	TrustedProxies     []string // Proxies whose client address headers are used
+	TrustedProxyHeader string   // The header trusted proxies set, defaults to X-Forwarded-For
+	Registry           RegistryList
+	LDAP               *LDAPConfig
+	SQL                *SQLConfig
+	Admin              *AdminConfig
+	Audit              *AuditConfig
+	Metrics            *MetricsConfig
+	Lockout            *LockoutConfig
+	Cache              *CredentialCacheConfig
+	Group              []*GroupConfig
+}
+
+// AdminConfig enables the admin API for the listed users. The API is served on
+// Addr if set, otherwise on the main listener.
+type AdminConfig struct {
+	Enabled bool
+	Addr    string
+	Users   []string
+}
+
+// MetricsConfig enables the Prometheus metrics endpoint. It's served on Addr if
+// set, otherwise on the main listener.
+type MetricsConfig struct {
+	Enabled bool
+	Addr    string
+}
+
+// AuditConfig enables the audit log of token decisions. Events are written to
+// File, or stdout if it's empty or "-". The file is rotated once it's larger
+// than MaxSize megabytes and MaxBackups rotated files are kept.
+type AuditConfig struct {
+	Enabled    bool
+	File       string
+	MaxSize    int
+	MaxBackups int
+}
+
+// RegistryList is the registries served by the auth server, configured with
+// [[registry]] blocks. A single [registry] table is accepted as well.
+type RegistryList []*RegistryConfig
+
+func (l *RegistryList) UnmarshalTOML(decode func(interface{}) error) error {
+	var raw interface{}
+	if err := decode(&raw); err != nil {
+		return err
+	}
+
+	if _, ok := raw.(map[string]interface{}); ok {
+		r := &RegistryConfig{}
+		if err := decode(r); err != nil {
+			return err
+		}
+		*l = RegistryList{r}
+		return nil
+	}
+
+	var list []*RegistryConfig
+	if err := decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// Get returns the registry named name or nil if there isn't one.
+func (l RegistryList) Get(name string) *RegistryConfig {
+	for _, r := range l {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
 }
 
 type RegistryConfig struct {
 	Address     string
 	Name        string
 	AllowDelete bool
-	Auth        struct {
-		Enabled bool
-		Key     string
-		Issuer  string
+	Anonymous   struct {
+		Enabled     bool
+		Permissions []*AccessControl
+	}
+	Auth struct {
+		Enabled         bool
+		Key             string
+		Cert            string
+		Keys            []*KeyConfig
+		Issuer          string
+		URL             string
+		TokenTTL        Duration
+		ClockSkew       Duration
+		ActionTTL       map[string]Duration
+		RefreshTokenTTL Duration
 	}
 }
 
+// GroupConfig grants permissions to members of a group.
+type GroupConfig struct {
+	Name        string
+	Permissions []*AccessControl
+}
+
 type UserAccessConfig struct {
 	User []*UserConfig
 }
@@ -36,13 +146,22 @@ type UserConfig struct {
 	Username    string
 	Password    string
 	Hash        string
+	Groups      []string
+	TokenTTL    Duration
+	ActionTTL   map[string]Duration
 	Permissions []*AccessControl
 }
 
-func LoadConfig(path string) (err error) {
+// LoadConfig reads and validates the configuration file at path.
+func LoadConfig(path string) (*Config, error) {
 	c, err := parseConfig(path)
-	config = c
-	return err
+	if err != nil {
+		return nil, err
+	}
+	if err := validateConfig(c); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
 func parseConfig(path string) (c *Config, err error) {
@@ -116,5 +235,97 @@ func parseUserConfig(path string) (c *UserAccessConfig, err error) {
 		return nil, err
 	}
 
+	for _, u := range con.User {
+		if err := validateACLs(u.Permissions); err != nil {
+			return nil, fmt.Errorf("user %q: %w", u.Username, err)
+		}
+	}
+
 	return &con, nil
 }
+
+// userFileConfig is the layout of accounts files written by writeUserConfig.
+// Unset optional settings are left out.
+type userFileConfig struct {
+	User []*userFileEntry `toml:"user"`
+}
+
+type userFileEntry struct {
+	Username    string                `toml:"username"`
+	Password    string                `toml:"password"`
+	Hash        string                `toml:"hash,omitempty"`
+	Groups      []string              `toml:"groups,omitempty"`
+	TokenTTL    *Duration             `toml:"tokenTTL,omitempty"`
+	ActionTTL   map[string]Duration   `toml:"actionTTL,omitempty"`
+	Permissions []*userFilePermission `toml:"permissions,omitempty"`
+}
+
+type userFilePermission struct {
+	IP      string   `toml:"ip"`
+	Service string   `toml:"service,omitempty"`
+	Type    string   `toml:"type,omitempty"`
+	Name    string   `toml:"name"`
+	Actions []string `toml:"actions"`
+}
+
+// writeUserConfig atomically replaces the accounts file at path with users.
+// Comments in the existing file are lost.
+func writeUserConfig(path string, users []*UserConfig) error {
+	c := &userFileConfig{User: make([]*userFileEntry, len(users))}
+	for i, u := range users {
+		entry := &userFileEntry{
+			Username:  u.Username,
+			Password:  u.Password,
+			Hash:      u.Hash,
+			Groups:    u.Groups,
+			ActionTTL: u.ActionTTL,
+		}
+		if u.TokenTTL.Duration != 0 {
+			entry.TokenTTL = &Duration{u.TokenTTL.Duration}
+		}
+		for _, p := range u.Permissions {
+			entry.Permissions = append(entry.Permissions, &userFilePermission{
+				IP:      p.IP,
+				Service: p.Service,
+				Type:    p.Type,
+				Name:    p.Name,
+				Actions: p.Actions,
+			})
+		}
+		c.User[i] = entry
+	}
+
+	buf, err := toml.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	// Write to a temporary file in the same directory so the rename is atomic
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,152 @@
+package dockerauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+const defaultCredentialCacheTTL = time.Minute
+
+// CredentialCacheConfig enables remembering successful logins for TTL so
+// repeated token requests don't verify the same password hash every time.
+type CredentialCacheConfig struct {
+	Enabled bool
+	TTL     Duration
+}
+
+// CredentialCache is implemented by UserAuthenticators which remember
+// verified credentials. The Authenticator forgets a user's credentials when
+// they're changed through the admin API.
+type CredentialCache interface {
+	Forget(username string)
+	Flush()
+}
+
+// ForgetCredentials makes the UserAuthenticator, if it caches credentials,
+// verify the next login of username again.
+func (a *Authenticator) ForgetCredentials(username string) {
+	if cache, ok := a.userAuthenticator.(CredentialCache); ok {
+		cache.Forget(username)
+	}
+}
+
+// FlushCredentials makes the UserAuthenticator, if it caches credentials,
+// verify all logins again. It's used after users are reloaded, so the user
+// metrics are read again as well.
+func (a *Authenticator) FlushCredentials() {
+	a.metrics.resetUserStats()
+	if cache, ok := a.userAuthenticator.(CredentialCache); ok {
+		cache.Flush()
+	}
+}
+
+// credentialEntry is a verified password of a user.
+type credentialEntry struct {
+	mac     []byte
+	expires time.Time
+}
+
+// CachingAuthenticator wraps a UserAuthenticator to remember successful logins
+// for a short time. Passwords aren't kept, only an HMAC of the username and
+// password keyed with a random secret which never leaves the process. Failed
+// logins are always passed to the wrapped UserAuthenticator.
+type CachingAuthenticator struct {
+	ua  UserAuthenticator
+	ttl time.Duration
+	key []byte
+	now func() time.Time
+
+	m       sync.Mutex
+	entries map[string]*credentialEntry
+}
+
+// NewCachingAuthenticator wraps ua, remembering successful logins for ttl or
+// a minute if ttl isn't positive.
+func NewCachingAuthenticator(ua UserAuthenticator, ttl time.Duration) (*CachingAuthenticator, error) {
+	if ttl <= 0 {
+		ttl = defaultCredentialCacheTTL
+	}
+
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return &CachingAuthenticator{
+		ua:      ua,
+		ttl:     ttl,
+		key:     key,
+		now:     time.Now,
+		entries: make(map[string]*credentialEntry),
+	}, nil
+}
+
+func (c *CachingAuthenticator) Login(username, password string) (bool, error) {
+	return c.LoginFromIP(username, password, "")
+}
+
+// LoginFromIP checks the credentials of username, passing ip on if the wrapped
+// UserAuthenticator uses it.
+func (c *CachingAuthenticator) LoginFromIP(username, password, ip string) (bool, error) {
+	mac := c.mac(username, password)
+	if c.cached(username, mac) {
+		return true, nil
+	}
+
+	var ok bool
+	var err error
+	if ua, isIP := c.ua.(IPUserAuthenticator); isIP {
+		ok, err = ua.LoginFromIP(username, password, ip)
+	} else {
+		ok, err = c.ua.Login(username, password)
+	}
+	if err != nil || !ok {
+		return ok, err
+	}
+
+	c.m.Lock()
+	c.entries[username] = &credentialEntry{mac: mac, expires: c.now().Add(c.ttl)}
+	c.m.Unlock()
+	return true, nil
+}
+
+func (c *CachingAuthenticator) mac(username, password string) []byte {
+	h := hmac.New(sha256.New, c.key)
+	h.Write([]byte(username))
+	h.Write([]byte{0})
+	h.Write([]byte(password))
+	return h.Sum(nil)
+}
+
+// cached checks if mac is the unexpired verified credential of username.
+func (c *CachingAuthenticator) cached(username string, mac []byte) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	e := c.entries[username]
+	if e == nil {
+		return false
+	}
+	if !c.now().Before(e.expires) {
+		delete(c.entries, username)
+		return false
+	}
+	return hmac.Equal(e.mac, mac)
+}
+
+// Forget removes the remembered credentials of username.
+func (c *CachingAuthenticator) Forget(username string) {
+	c.m.Lock()
+	delete(c.entries, username)
+	c.m.Unlock()
+}
+
+// Flush removes all remembered credentials.
+func (c *CachingAuthenticator) Flush() {
+	c.m.Lock()
+	c.entries = make(map[string]*credentialEntry)
+	c.m.Unlock()
+}
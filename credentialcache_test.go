@@ -0,0 +1,92 @@
+package dockerauth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCachingAuthenticator(t *testing.T) {
+	ua := &countingAuthenticator{}
+	c, err := NewCachingAuthenticator(ua, time.Minute)
+	ok(t, err)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		loggedIn, err := c.Login("test", "testing")
+		ok(t, err)
+		assert(t, loggedIn, "Login failed")
+	}
+	equals(t, ua.logins, 1)
+
+	// Other passwords and failures aren't cached
+	for i := 0; i < 2; i++ {
+		loggedIn, err := c.Login("test", "wrong")
+		ok(t, err)
+		assert(t, !loggedIn, "Wrong password was accepted")
+	}
+	equals(t, ua.logins, 3)
+
+	now = now.Add(time.Minute)
+	_, err = c.Login("test", "testing")
+	ok(t, err)
+	equals(t, ua.logins, 4)
+
+	c.Forget("test")
+	_, err = c.Login("test", "testing")
+	ok(t, err)
+	equals(t, ua.logins, 5)
+
+	c.Flush()
+	_, err = c.Login("test", "testing")
+	ok(t, err)
+	equals(t, ua.logins, 6)
+}
+
+func TestCachingAuthenticatorLockout(t *testing.T) {
+	now := time.Now()
+	ua := &countingAuthenticator{}
+	c, err := NewCachingAuthenticator(newTestLockout(ua, &now), time.Minute)
+	ok(t, err)
+
+	_, err = c.LoginFromIP("test", "testing", "10.0.0.1")
+	ok(t, err)
+
+	// The client's IP is passed on to the lockout
+	for i := 0; i < 5; i++ {
+		c.LoginFromIP("user"+string(rune('a'+i)), "wrong", "10.0.0.2")
+	}
+	_, err = c.LoginFromIP("test", "other", "10.0.0.2")
+	assert(t, err != nil, "Expected the IP to be locked out")
+
+	// Verified credentials are still accepted
+	loggedIn, err := c.LoginFromIP("test", "testing", "10.0.0.2")
+	ok(t, err)
+	assert(t, loggedIn, "Cached login failed")
+	equals(t, ua.logins, 6)
+}
+
+func TestForgetCredentials(t *testing.T) {
+	ua := &countingAuthenticator{}
+	c, err := NewCachingAuthenticator(ua, time.Minute)
+	ok(t, err)
+	a := newTestAuthenticator()
+	a.userAuthenticator = c
+
+	_, err = c.Login("test", "testing")
+	ok(t, err)
+	a.ForgetCredentials("other")
+	_, err = c.Login("test", "testing")
+	ok(t, err)
+	equals(t, ua.logins, 1)
+
+	a.ForgetCredentials("test")
+	_, err = c.Login("test", "testing")
+	ok(t, err)
+	equals(t, ua.logins, 2)
+
+	a.FlushCredentials()
+	_, err = c.Login("test", "testing")
+	ok(t, err)
+	equals(t, ua.logins, 3)
+}
@@ -0,0 +1,84 @@
+package dockerauth
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// Error codes of the distribution registry API. The Docker CLI shows the
+// message of errors with these codes to the user.
+const (
+	errorCodeUnauthorized    = "UNAUTHORIZED"
+	errorCodeDenied          = "DENIED"
+	errorCodeUnsupported     = "UNSUPPORTED"
+	errorCodeTooManyRequests = "TOOMANYREQUESTS"
+	errorCodeUnavailable     = "UNAVAILABLE"
+	errorCodeUnknown         = "UNKNOWN"
+)
+
+// tokenRealm is the realm of the Basic challenge sent with failed logins.
+const tokenRealm = "Docker registry"
+
+// apiError is an error in the format of the distribution registry API.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type apiErrorResponse struct {
+	Errors []*apiError `json:"errors"`
+}
+
+// errorStatus returns the HTTP status and registry error code for err.
+// Messages of unexpected errors aren't shown to clients.
+func errorStatus(err error) (int, *apiError) {
+	switch {
+	case errors.Is(err, ErrTooManyAttempts):
+		return http.StatusTooManyRequests, &apiError{errorCodeTooManyRequests, ErrTooManyAttempts.Error()}
+	case errors.Is(err, ErrInvalidLogin):
+		return http.StatusUnauthorized, &apiError{errorCodeUnauthorized, ErrInvalidLogin.Error()}
+	case errors.Is(err, ErrInvalidRefreshToken):
+		return http.StatusUnauthorized, &apiError{errorCodeUnauthorized, ErrInvalidRefreshToken.Error()}
+	case errors.Is(err, ErrUnknownService):
+		return http.StatusForbidden, &apiError{errorCodeDenied, err.Error()}
+	case errors.Is(err, ErrInvalidScope), errors.Is(err, ErrMissingClientID),
+		errors.Is(err, ErrUnsupportedGrantType), errors.Is(err, ErrInvalidRequest):
+		return http.StatusBadRequest, &apiError{errorCodeUnsupported, err.Error()}
+	case errors.Is(err, ErrMethodNotAllowed):
+		return http.StatusMethodNotAllowed, &apiError{errorCodeUnsupported, ErrMethodNotAllowed.Error()}
+	case errors.Is(err, ErrCatalogUnavailable):
+		return http.StatusBadGateway, &apiError{errorCodeUnavailable, ErrCatalogUnavailable.Error()}
+	default:
+		return http.StatusInternalServerError, &apiError{errorCodeUnknown, "Internal server error"}
+	}
+}
+
+// WriteError writes err from a token request as a registry API error response
+// with a matching status. Failed logins get a Basic challenge, and lockouts a
+// Retry-After header.
+func WriteError(w http.ResponseWriter, err error) error {
+	status, apiErr := errorStatus(err)
+
+	SetRetryAfter(w, err)
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+tokenRealm+`"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(&apiErrorResponse{Errors: []*apiError{apiErr}})
+}
+
+// SetRetryAfter sets the Retry-After header to the seconds left if err is
+// from a lockout. It reports whether the header was set.
+func SetRetryAfter(w http.ResponseWriter, err error) bool {
+	var lockout *LockoutError
+	if !errors.As(err, &lockout) {
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(lockout.RetryAfter.Seconds()))))
+	return true
+}
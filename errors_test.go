@@ -0,0 +1,100 @@
+package dockerauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var writeErrorTests = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{ErrInvalidLogin, http.StatusUnauthorized, errorCodeUnauthorized},
+	{&LockoutError{Err: ErrTooManyAttempts, RetryAfter: time.Second}, http.StatusTooManyRequests, errorCodeTooManyRequests},
+	{ErrInvalidRefreshToken, http.StatusUnauthorized, errorCodeUnauthorized},
+	{ErrUnknownService, http.StatusForbidden, errorCodeDenied},
+	{ErrInvalidScope, http.StatusBadRequest, errorCodeUnsupported},
+	{ErrUnsupportedGrantType, http.StatusBadRequest, errorCodeUnsupported},
+	{ErrMethodNotAllowed, http.StatusMethodNotAllowed, errorCodeUnsupported},
+	{fmt.Errorf("%w: 503 Service Unavailable", ErrCatalogUnavailable), http.StatusBadGateway, errorCodeUnavailable},
+	{errors.New("database is down"), http.StatusInternalServerError, errorCodeUnknown},
+}
+
+func TestWriteError(t *testing.T) {
+	for _, test := range writeErrorTests {
+		w := httptest.NewRecorder()
+		ok(t, WriteError(w, test.err))
+		equals(t, w.Code, test.status)
+		equals(t, w.Header().Get("Content-Type"), "application/json")
+
+		resp := &apiErrorResponse{}
+		ok(t, json.Unmarshal(w.Body.Bytes(), resp))
+		equals(t, len(resp.Errors), 1)
+		equals(t, resp.Errors[0].Code, test.code)
+	}
+}
+
+func TestProcessRequestErrors(t *testing.T) {
+	a := newTestAuthenticator()
+
+	r := httptest.NewRequest("GET", "/api/auth?service=localhost:5000", nil)
+	r.SetBasicAuth("test", "wrong")
+	w := httptest.NewRecorder()
+	ok(t, WriteError(w, a.ProcessRequest(w, r)))
+	equals(t, w.Code, http.StatusUnauthorized)
+	equals(t, w.Header().Get("WWW-Authenticate"), `Basic realm="Docker registry"`)
+
+	r = httptest.NewRequest("GET", "/api/auth?service=unknown:5000", nil)
+	r.SetBasicAuth("test", "testing")
+	w = httptest.NewRecorder()
+	ok(t, WriteError(w, a.ProcessRequest(w, r)))
+	equals(t, w.Code, http.StatusForbidden)
+	equals(t, w.Header().Get("WWW-Authenticate"), "")
+
+	resp := &apiErrorResponse{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), resp))
+	equals(t, resp.Errors[0].Message, `Unknown service: "unknown:5000"`)
+
+	r = httptest.NewRequest("GET", "/api/auth?service=localhost:5000&scope=repository", nil)
+	r.SetBasicAuth("test", "testing")
+	w = httptest.NewRecorder()
+	ok(t, WriteError(w, a.ProcessRequest(w, r)))
+	equals(t, w.Code, http.StatusBadRequest)
+
+	w = httptest.NewRecorder()
+	ok(t, WriteError(w, &LockoutError{Err: ErrInvalidLogin, RetryAfter: 1500 * time.Millisecond}))
+	equals(t, w.Code, http.StatusUnauthorized)
+	equals(t, w.Header().Get("Retry-After"), "2")
+}
+
+func TestProcessRevokeRequestErrors(t *testing.T) {
+	a := newTestAuthenticator()
+
+	r := httptest.NewRequest("GET", "/token/revoke", nil)
+	w := httptest.NewRecorder()
+	ok(t, WriteError(w, a.ProcessRevokeRequest(w, r)))
+	equals(t, w.Code, http.StatusMethodNotAllowed)
+
+	r = httptest.NewRequest("POST", "/token/revoke", strings.NewReader("token=garbage"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	ok(t, WriteError(w, a.ProcessRevokeRequest(w, r)))
+	equals(t, w.Code, http.StatusUnauthorized)
+}
+
+func TestProcessDiscoveryRequestErrors(t *testing.T) {
+	a := newTestAuthenticator()
+
+	r := httptest.NewRequest("GET", DiscoveryPath+"?service=unknown:5000", nil)
+	w := httptest.NewRecorder()
+	ok(t, WriteError(w, a.ProcessDiscoveryRequest(w, r)))
+	equals(t, w.Code, http.StatusForbidden)
+	assert(t, strings.Contains(w.Body.String(), errorCodeDenied), "Missing error code: %s", w.Body.String())
+}
@@ -1,13 +1,18 @@
 package dockerauth
 
 import (
-	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	passlib "gopkg.in/hlandau/passlib.v1"
 )
 
 type FileAuthenticator struct {
+	filename string
+
+	m     sync.RWMutex
+	list  []*UserConfig // Users in file order
 	users map[string]*UserConfig
 }
 
@@ -17,18 +22,45 @@ func NewFileAuthenticator(filename string) (*FileAuthenticator, error) {
 		return nil, err
 	}
 
+	a := &FileAuthenticator{filename: filename}
+	a.setUsers(c.User)
+	return a, nil
+}
+
+// Reload reads the accounts file again. The current users are kept if the
+// file can't be loaded.
+func (a *FileAuthenticator) Reload() error {
+	c, err := parseUserConfig(a.filename)
+	if err != nil {
+		return err
+	}
+
+	a.m.Lock()
+	a.setUsers(c.User)
+	a.m.Unlock()
+	return nil
+}
+
+func (a *FileAuthenticator) setUsers(list []*UserConfig) {
 	users := make(map[string]*UserConfig)
-	for _, u := range c.User {
+	for _, u := range list {
 		users[u.Username] = u
 	}
 
-	return &FileAuthenticator{
-		users: users,
-	}, nil
+	a.list = list
+	a.users = users
 }
 
-func (a *FileAuthenticator) Login(username, password string) (bool, error) {
+func (a *FileAuthenticator) getUser(username string) (*UserConfig, bool) {
+	a.m.RLock()
+	defer a.m.RUnlock()
+
 	user, exists := a.users[username]
+	return user, exists
+}
+
+func (a *FileAuthenticator) Login(username, password string) (bool, error) {
+	user, exists := a.getUser(username)
 	if !exists {
 		return false, nil
 	}
@@ -49,10 +81,126 @@ func (a *FileAuthenticator) checkPassword(username, password, expected, hash str
 }
 
 func (a *FileAuthenticator) GetACLS(username string) ([]*AccessControl, error) {
-	u, exists := a.users[username]
+	u, exists := a.getUser(username)
 	if !exists {
-		return nil, errors.New("User doesn't exist")
+		return nil, ErrUserNotFound
 	}
 
 	return u.Permissions, nil
 }
+
+func (a *FileAuthenticator) GetGroups(username string) ([]string, error) {
+	u, exists := a.getUser(username)
+	if !exists {
+		return nil, nil
+	}
+
+	return u.Groups, nil
+}
+
+func (a *FileAuthenticator) GetTokenLifetime(username string) (*TokenLifetime, error) {
+	u, exists := a.getUser(username)
+	if !exists {
+		return nil, nil
+	}
+
+	lifetime := &TokenLifetime{
+		TTL:       u.TokenTTL.Duration,
+		ActionTTL: make(map[string]time.Duration, len(u.ActionTTL)),
+	}
+	for action, d := range u.ActionTTL {
+		lifetime.ActionTTL[action] = d.Duration
+	}
+	return lifetime, nil
+}
+
+func (a *FileAuthenticator) ListUsers() ([]*UserConfig, error) {
+	a.m.RLock()
+	defer a.m.RUnlock()
+
+	users := make([]*UserConfig, len(a.list))
+	for i, u := range a.list {
+		users[i] = copyUserConfig(u)
+	}
+	return users, nil
+}
+
+func (a *FileAuthenticator) GetUser(username string) (*UserConfig, error) {
+	u, exists := a.getUser(username)
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+	return copyUserConfig(u), nil
+}
+
+func (a *FileAuthenticator) CreateUser(user *UserConfig) error {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if _, exists := a.users[user.Username]; exists {
+		return ErrUserExists
+	}
+
+	list := append(a.list[:len(a.list):len(a.list)], copyUserConfig(user))
+	return a.writeUsers(list)
+}
+
+func (a *FileAuthenticator) UpdateUser(user *UserConfig) error {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	list := make([]*UserConfig, len(a.list))
+	found := false
+	for i, u := range a.list {
+		if u.Username == user.Username {
+			u = copyUserConfig(user)
+			found = true
+		}
+		list[i] = u
+	}
+	if !found {
+		return ErrUserNotFound
+	}
+	return a.writeUsers(list)
+}
+
+func (a *FileAuthenticator) DeleteUser(username string) error {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	list := make([]*UserConfig, 0, len(a.list))
+	for _, u := range a.list {
+		if u.Username != username {
+			list = append(list, u)
+		}
+	}
+	if len(list) == len(a.list) {
+		return ErrUserNotFound
+	}
+	return a.writeUsers(list)
+}
+
+// writeUsers rewrites the accounts file and then replaces the users in memory.
+// The caller must hold the write lock.
+func (a *FileAuthenticator) writeUsers(list []*UserConfig) error {
+	if err := writeUserConfig(a.filename, list); err != nil {
+		return err
+	}
+	a.setUsers(list)
+	return nil
+}
+
+// copyUserConfig copies u so it can be modified without affecting the
+// original.
+func copyUserConfig(u *UserConfig) *UserConfig {
+	c := *u
+	c.Groups = append([]string(nil), u.Groups...)
+	c.Permissions = append([]*AccessControl(nil), u.Permissions...)
+	if u.ActionTTL != nil {
+		c.ActionTTL = make(map[string]Duration, len(u.ActionTTL))
+		for action, d := range u.ActionTTL {
+			c.ActionTTL[action] = d
+		}
+	}
+	return &c
+}
@@ -0,0 +1,138 @@
+package dockerauth
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+var ErrInvalidIPList = errors.New("invalid IP address or CIDR")
+
+// ipList is a list of IPv4 and IPv6 networks an address can be matched
+// against.
+type ipList struct {
+	any      bool
+	prefixes []netip.Prefix
+}
+
+// parseIPList parses a comma or space separated list of IP addresses and CIDR
+// prefixes such as "10.0.0.0/8, 192.168.1.5, fd00::/8". "*" matches every
+// address. IPv4 addresses with trailing "*" octets, such as "10.1.*", are read
+// as the matching prefix for compatibility with older configurations.
+func parseIPList(s string) (*ipList, error) {
+	entries := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w: no addresses given", ErrInvalidIPList)
+	}
+
+	l := &ipList{}
+	for _, entry := range entries {
+		if entry == "*" {
+			l.any = true
+			continue
+		}
+
+		prefix, err := parseIPPrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q", ErrInvalidIPList, entry)
+		}
+		l.prefixes = append(l.prefixes, prefix)
+	}
+	return l, nil
+}
+
+// parseIPPrefix parses a CIDR prefix, a single address or a wildcard IPv4
+// address.
+func parseIPPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return prefix.Masked(), nil
+	}
+
+	if strings.HasSuffix(s, "*") {
+		return parseWildcardIPv4(s)
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// parseWildcardIPv4 converts addresses like "10.*" or "192.168.1.*" to the
+// prefix they match. Wildcards can only replace whole trailing octets.
+func parseWildcardIPv4(s string) (netip.Prefix, error) {
+	octets := strings.Split(s, ".")
+	if len(octets) > 4 {
+		return netip.Prefix{}, ErrInvalidIPList
+	}
+
+	fixed := 0
+	for fixed < len(octets) && octets[fixed] != "*" {
+		fixed++
+	}
+	for _, octet := range octets[fixed:] {
+		if octet != "*" {
+			return netip.Prefix{}, ErrInvalidIPList
+		}
+	}
+
+	full := append(octets[:fixed:fixed], "0", "0", "0", "0")[:4]
+	addr, err := netip.ParseAddr(strings.Join(full, "."))
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, fixed*8), nil
+}
+
+// contains checks if ip is in any of the list's networks.
+func (l *ipList) contains(ip netip.Addr) bool {
+	if l.any {
+		return true
+	}
+
+	ip = ip.Unmap().WithZone("")
+	for _, prefix := range l.prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHostIP returns the IP address of addr, which may include a port as in
+// http.Request.RemoteAddr. IPv6 addresses may be in brackets.
+func parseHostIP(addr string) (netip.Addr, error) {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	} else if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		addr = addr[1 : len(addr)-1]
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return ip.Unmap(), nil
+}
+
+// validateACLs checks the IP restrictions of acls can be parsed.
+func validateACLs(acls []*AccessControl) error {
+	for _, acl := range acls {
+		if _, err := parseIPList(acl.IP); err != nil {
+			return fmt.Errorf("permission for %q: %w", acl.Name, err)
+		}
+	}
+	return nil
+}
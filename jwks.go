@@ -0,0 +1,152 @@
+package dockerauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+const (
+	JWKSPath      = "/.well-known/jwks.json"
+	DiscoveryPath = "/.well-known/openid-configuration"
+)
+
+// jwk is the JSON Web Key representation of a public signing key.
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type jwkSet struct {
+	Keys []*jwk `json:"keys"`
+}
+
+type discoveryDocument struct {
+	Issuer                           string   `json:"issuer"`
+	JWKSURI                          string   `json:"jwks_uri"`
+	TokenEndpoint                    string   `json:"token_endpoint"`
+	GrantTypesSupported              []string `json:"grant_types_supported"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+}
+
+func newJWK(signer Signer) *jwk {
+	key := &jwk{
+		Use: "sig",
+		Alg: signer.Alg(),
+		Kid: signer.KeyID(),
+	}
+
+	switch pub := signer.PublicKey().(type) {
+	case *rsa.PublicKey:
+		key.Kty = "RSA"
+		key.N = string(base64Encode(pub.N.Bytes()))
+		key.E = string(base64Encode(big.NewInt(int64(pub.E)).Bytes()))
+
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		x := make([]byte, size)
+		y := make([]byte, size)
+		pub.X.FillBytes(x)
+		pub.Y.FillBytes(y)
+
+		key.Kty = "EC"
+		key.Crv = pub.Curve.Params().Name
+		key.X = string(base64Encode(x))
+		key.Y = string(base64Encode(y))
+
+	case ed25519.PublicKey:
+		key.Kty = "OKP"
+		key.Crv = "Ed25519"
+		key.X = string(base64Encode(pub))
+	}
+	return key
+}
+
+// getJWKS returns the public half of every signing key of every registry,
+// active and retiring. Keys shared by registries are listed once.
+func (c *authConfig) getJWKS() *jwkSet {
+	set := &jwkSet{Keys: []*jwk{}}
+	seen := make(map[string]bool)
+	for _, reg := range c.registries {
+		for _, signer := range reg.keys.Signers() {
+			if !seen[signer.KeyID()] {
+				seen[signer.KeyID()] = true
+				set.Keys = append(set.Keys, newJWK(signer))
+			}
+		}
+	}
+	return set
+}
+
+// ProcessJWKSRequest writes the JSON Web Key Set used to verify tokens.
+func (a *Authenticator) ProcessJWKSRequest(w http.ResponseWriter, r *http.Request) error {
+	set := a.getConfig().getJWKS()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	return json.NewEncoder(w).Encode(set)
+}
+
+// ProcessDiscoveryRequest writes an OpenID style discovery document naming
+// the issuer and where to find its keys. The registry is chosen with the
+// service parameter, the first registry is used without it.
+func (a *Authenticator) ProcessDiscoveryRequest(w http.ResponseWriter, r *http.Request) error {
+	reg, err := a.getConfig().requestRegistry(r)
+	if err != nil {
+		return err
+	}
+
+	algs := []string{}
+	for _, signer := range reg.keys.Signers() {
+		if !stringInSlice(signer.Alg(), algs) {
+			algs = append(algs, signer.Alg())
+		}
+	}
+
+	baseURL := reg.publicURL(r)
+	doc := &discoveryDocument{
+		Issuer:                           reg.Auth.Issuer,
+		JWKSURI:                          baseURL + JWKSPath,
+		TokenEndpoint:                    baseURL + "/token",
+		GrantTypesSupported:              []string{"password", "refresh_token"},
+		IDTokenSigningAlgValuesSupported: algs,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	return json.NewEncoder(w).Encode(doc)
+}
+
+// publicURL returns the configured external URL of the server or one built
+// from the request if none is set.
+func (reg *registry) publicURL(r *http.Request) string {
+	if reg.Auth.URL != "" {
+		return strings.TrimRight(reg.Auth.URL, "/")
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package dockerauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func decodeJWKInt(t *testing.T, s string) *big.Int {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	ok(t, err)
+	return new(big.Int).SetBytes(buf)
+}
+
+func TestJWKS(t *testing.T) {
+	a := newTestAuthenticator()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ok(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	ok(t, err)
+
+	config := a.getConfig().Config
+	config.Registry[0].Auth.Keys = []*KeyConfig{
+		{Path: "testdata/auth.key", State: KeyStateActive},
+		{Path: writeTestKey(t, ecKey), State: KeyStateRetiring},
+		{Path: writeTestKey(t, edKey), State: KeyStateRetiring},
+	}
+	ok(t, a.SetConfig(config, nil))
+
+	r, _ := http.NewRequest("GET", JWKSPath, nil)
+	w := httptest.NewRecorder()
+	ok(t, a.ProcessJWKSRequest(w, r))
+	equals(t, w.Header().Get("Content-Type"), "application/json")
+
+	set := &jwkSet{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), set))
+	equals(t, len(set.Keys), 3)
+
+	// RSA
+	rsaKey := set.Keys[0]
+	equals(t, rsaKey.Kid, privKeyID)
+	equals(t, rsaKey.Alg, "RS256")
+	rsaPub := &rsa.PublicKey{
+		N: decodeJWKInt(t, rsaKey.N),
+		E: int(decodeJWKInt(t, rsaKey.E).Int64()),
+	}
+	kid, err := getKeyID(rsaPub)
+	ok(t, err)
+	equals(t, kid, privKeyID)
+
+	// ECDSA
+	equals(t, set.Keys[1].Kty, "EC")
+	equals(t, set.Keys[1].Crv, "P-256")
+	ecPub := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     decodeJWKInt(t, set.Keys[1].X),
+		Y:     decodeJWKInt(t, set.Keys[1].Y),
+	}
+	kid, err = getKeyID(ecPub)
+	ok(t, err)
+	equals(t, kid, set.Keys[1].Kid)
+
+	// Ed25519
+	equals(t, set.Keys[2].Kty, "OKP")
+	equals(t, set.Keys[2].Alg, "EdDSA")
+	edPub, err := base64.RawURLEncoding.DecodeString(set.Keys[2].X)
+	ok(t, err)
+	kid, err = getKeyID(ed25519.PublicKey(edPub))
+	ok(t, err)
+	equals(t, kid, set.Keys[2].Kid)
+}
+
+func TestDiscoveryDocument(t *testing.T) {
+	a := newTestAuthenticator()
+
+	r, _ := http.NewRequest("GET", DiscoveryPath, nil)
+	r.Host = "auth.example.com"
+	w := httptest.NewRecorder()
+	ok(t, a.ProcessDiscoveryRequest(w, r))
+
+	doc := &discoveryDocument{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), doc))
+	equals(t, doc.Issuer, "test-issuer")
+	equals(t, doc.JWKSURI, "http://auth.example.com/.well-known/jwks.json")
+	equals(t, doc.IDTokenSigningAlgValuesSupported, []string{"RS256"})
+
+	testRegistry(a).Auth.URL = "https://auth.example.com/"
+	w = httptest.NewRecorder()
+	ok(t, a.ProcessDiscoveryRequest(w, r))
+	ok(t, json.Unmarshal(w.Body.Bytes(), doc))
+	equals(t, doc.JWKSURI, "https://auth.example.com/.well-known/jwks.json")
+	equals(t, doc.TokenEndpoint, "https://auth.example.com/token")
+}
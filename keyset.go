@@ -0,0 +1,255 @@
+package dockerauth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+)
+
+const (
+	KeyStateActive   = "active"
+	KeyStateRetiring = "retiring"
+)
+
+var (
+	ErrNoActiveKey       = errors.New("no active signing key configured")
+	ErrMultipleActiveKey = errors.New("only one signing key can be active")
+	ErrCertKeyMismatch   = errors.New("certificate doesn't match private key")
+)
+
+// KeyConfig is a signing key entry in the configuration.
+type KeyConfig struct {
+	Path  string
+	Cert  string
+	State string
+}
+
+// KeySet holds the signing keys of a registry. New tokens are signed with the
+// active key, tokens signed by retiring keys are still accepted so keys can be
+// rotated without invalidating outstanding tokens.
+type KeySet struct {
+	active *keySetEntry
+	keys   []*keySetEntry
+}
+
+type keySetEntry struct {
+	Signer
+	private crypto.Signer
+	cert    *x509.Certificate
+	x5c     []string
+	state   string
+}
+
+// LoadRegistryKeys loads the signing keys configured for registry r.
+func LoadRegistryKeys(r *RegistryConfig) (*KeySet, error) {
+	return LoadKeySet(registryKeyConfigs(r))
+}
+
+// registryKeyConfigs returns the signing keys of r, either the keys list or
+// the single key setting.
+func registryKeyConfigs(r *RegistryConfig) []*KeyConfig {
+	if len(r.Auth.Keys) > 0 {
+		return r.Auth.Keys
+	}
+	return []*KeyConfig{{
+		Path:  r.Auth.Key,
+		Cert:  r.Auth.Cert,
+		State: KeyStateActive,
+	}}
+}
+
+// LoadKeySet loads the configured keys. Exactly one key must be active, a key
+// without a state is active.
+func LoadKeySet(keys []*KeyConfig) (*KeySet, error) {
+	ks := &KeySet{}
+
+	for _, k := range keys {
+		entry, err := loadKeySetEntry(k)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", k.Path, err)
+		}
+
+		if entry.state == KeyStateActive {
+			if ks.active != nil {
+				return nil, ErrMultipleActiveKey
+			}
+			ks.active = entry
+		}
+		ks.keys = append(ks.keys, entry)
+	}
+
+	if ks.active == nil {
+		return nil, ErrNoActiveKey
+	}
+	return ks, nil
+}
+
+func loadKeySetEntry(k *KeyConfig) (*keySetEntry, error) {
+	state := k.State
+	if state == "" {
+		state = KeyStateActive
+	}
+	if state != KeyStateActive && state != KeyStateRetiring {
+		return nil, fmt.Errorf("unknown key state %q", state)
+	}
+
+	buf, err := ioutil.ReadFile(k.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parsePrivateKeyFromPEM(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := NewSigner(key)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &keySetEntry{
+		Signer:  signer,
+		private: key.(crypto.Signer),
+		state:   state,
+	}
+
+	if k.Cert != "" {
+		chain, err := loadCertificateChain(k.Cert)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkCertificateKey(chain[0], signer); err != nil {
+			return nil, err
+		}
+
+		entry.cert = chain[0]
+		for _, cert := range chain {
+			entry.x5c = append(entry.x5c, base64.StdEncoding.EncodeToString(cert.Raw))
+		}
+	}
+	return entry, nil
+}
+
+// loadCertificateChain reads PEM encoded certificates from path. The first
+// certificate is the leaf, any following are intermediates each signed by the
+// next.
+func loadCertificateChain(path string) ([]*x509.Certificate, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var chain []*x509.Certificate
+	for block, rest := pem.Decode(buf); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(chain) > 0 {
+			if err := chain[len(chain)-1].CheckSignatureFrom(cert); err != nil {
+				return nil, fmt.Errorf("%s: invalid certificate chain: %s", path, err)
+			}
+		}
+		chain = append(chain, cert)
+	}
+
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("%s: no PEM encoded certificate found", path)
+	}
+	return chain, nil
+}
+
+func checkCertificateKey(cert *x509.Certificate, signer Signer) error {
+	certKeyID, err := getKeyID(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+	if certKeyID != signer.KeyID() {
+		return ErrCertKeyMismatch
+	}
+	return nil
+}
+
+// Active returns the signer used for new tokens.
+func (k *KeySet) Active() Signer {
+	return k.active
+}
+
+// Signers returns all keys in the set, active and retiring.
+func (k *KeySet) Signers() []Signer {
+	signers := make([]Signer, len(k.keys))
+	for i, key := range k.keys {
+		signers[i] = key.Signer
+	}
+	return signers
+}
+
+// Lookup returns the key with the key ID kid or nil if it isn't in the set.
+func (k *KeySet) Lookup(kid string) Signer {
+	for _, key := range k.keys {
+		if key.KeyID() == kid {
+			return key.Signer
+		}
+	}
+	return nil
+}
+
+// CertBundle returns PEM encoded certificates for every key in the set suitable
+// for the registry's rootcertbundle. Keys without a configured certificate get
+// a self-signed one.
+func (k *KeySet) CertBundle() ([]byte, error) {
+	var buf bytes.Buffer
+	for _, key := range k.keys {
+		cert := key.cert
+		if cert == nil {
+			var err error
+			cert, err = selfSignedCertificate(key)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func selfSignedCertificate(key *keySetEntry) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: key.KeyID()},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.PublicKey(), key.private)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
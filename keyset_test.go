@@ -0,0 +1,196 @@
+package dockerauth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeySetLoad(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ok(t, err)
+	ecPath := writeTestKey(t, key)
+
+	_, err = LoadKeySet([]*KeyConfig{
+		{Path: "testdata/auth.key", State: KeyStateActive},
+		{Path: ecPath},
+	})
+	equals(t, err, ErrMultipleActiveKey)
+
+	_, err = LoadKeySet([]*KeyConfig{
+		{Path: "testdata/auth.key", State: KeyStateRetiring},
+	})
+	equals(t, err, ErrNoActiveKey)
+
+	_, err = LoadKeySet([]*KeyConfig{
+		{Path: "testdata/auth.key", State: "expired"},
+	})
+	assert(t, err != nil, "Expected unknown key state error")
+
+	_, err = LoadKeySet([]*KeyConfig{
+		{Path: ecPath, Cert: "testdata/auth.cert"},
+	})
+	assert(t, err != nil, "Expected certificate mismatch error")
+
+	ks, err := LoadKeySet([]*KeyConfig{
+		{Path: "testdata/auth.key", Cert: "testdata/auth.cert", State: KeyStateRetiring},
+		{Path: ecPath, State: KeyStateActive},
+	})
+	ok(t, err)
+	equals(t, ks.Active().Alg(), "ES256")
+	equals(t, len(ks.Signers()), 2)
+	equals(t, ks.Lookup(privKeyID).Alg(), "RS256")
+	assert(t, ks.Lookup("nope") == nil, "Unknown key ID found in key set")
+}
+
+func TestKeySetCertBundle(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	ok(t, err)
+
+	ks, err := LoadKeySet([]*KeyConfig{
+		{Path: writeTestKey(t, key), State: KeyStateActive},
+		{Path: "testdata/auth.key", Cert: "testdata/auth.cert", State: KeyStateRetiring},
+	})
+	ok(t, err)
+
+	bundle, err := ks.CertBundle()
+	ok(t, err)
+
+	var keyIDs []string
+	for block, rest := pem.Decode(bundle); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		ok(t, err)
+		kid, err := getKeyID(cert.PublicKey)
+		ok(t, err)
+		keyIDs = append(keyIDs, kid)
+	}
+
+	equals(t, keyIDs, []string{ks.Active().KeyID(), privKeyID})
+}
+
+func TestKeySetRotation(t *testing.T) {
+	a := newTestAuthenticator()
+
+	refreshToken, err := a.GenerateRefreshToken("localhost:5000", "test", "test-client")
+	ok(t, err)
+
+	// Rotate to a new key, the old one is kept around while it's retiring
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ok(t, err)
+	config := a.getConfig().Config
+	config.Registry[0].Auth.Keys = []*KeyConfig{
+		{Path: writeTestKey(t, key), State: KeyStateActive},
+		{Path: "testdata/auth.key", State: KeyStateRetiring},
+	}
+	ok(t, a.SetConfig(config, nil))
+
+	token, err := a.GenerateToken("localhost:5000", "test", nil)
+	ok(t, err)
+	keys := testRegistry(a).keys
+	ok(t, decodeJWT(token, &jwtPayload{}, keys))
+	equals(t, keys.Active().Alg(), "ES256")
+
+	username, err := a.validateRefreshToken(testRegistry(a), refreshToken)
+	ok(t, err)
+	equals(t, username, "test")
+
+	// Once the old key is removed its tokens are no longer valid
+	config.Registry[0].Auth.Keys = config.Registry[0].Auth.Keys[:1]
+	ok(t, a.SetConfig(config, nil))
+
+	_, err = a.validateRefreshToken(testRegistry(a), refreshToken)
+	equals(t, err, ErrInvalidRefreshToken)
+}
+
+func newTestCertificate(t *testing.T, cn string, pub crypto.PublicKey, parent *x509.Certificate, parentKey crypto.Signer) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent = template
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, parentKey)
+	ok(t, err)
+	cert, err := x509.ParseCertificate(der)
+	ok(t, err)
+	return cert
+}
+
+func TestKeySetCertificateChain(t *testing.T) {
+	a := newTestAuthenticator()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ok(t, err)
+	ca := newTestCertificate(t, "Test CA", caKey.Public(), nil, caKey)
+
+	signer, err := LoadSigner("testdata/auth.key")
+	ok(t, err)
+	leaf := newTestCertificate(t, "auth", signer.PublicKey(), ca, caKey)
+
+	chainPath := filepath.Join(t.TempDir(), "auth.cert")
+	var buf bytes.Buffer
+	ok(t, pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}))
+	ok(t, pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}))
+	ok(t, os.WriteFile(chainPath, buf.Bytes(), 0600))
+
+	config := a.getConfig().Config
+	config.Registry[0].Auth.Cert = chainPath
+	ok(t, a.SetConfig(config, nil))
+
+	token, err := a.GenerateToken("localhost:5000", "test", nil)
+	ok(t, err)
+
+	header := &jwtHeader{}
+	ok(t, jsonDecodeJWTSection([]byte(strings.Split(token, ".")[0]), header))
+	equals(t, len(header.X5c), 2)
+
+	// Verify the chain the way the registry does
+	var certs []*x509.Certificate
+	for _, c := range header.X5c {
+		der, err := base64.StdEncoding.DecodeString(c)
+		ok(t, err)
+		cert, err := x509.ParseCertificate(der)
+		ok(t, err)
+		certs = append(certs, cert)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(certs[1])
+	_, err = certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	ok(t, err)
+
+	kid, err := getKeyID(certs[0].PublicKey)
+	ok(t, err)
+	equals(t, kid, header.Kid)
+
+	// A certificate for a different key is rejected at startup
+	config.Registry[0].Auth.Keys = []*KeyConfig{
+		{Path: writeTestKey(t, caKey), Cert: chainPath},
+	}
+	assert(t, a.SetConfig(config, nil) != nil, "Expected certificate mismatch error")
+}
@@ -0,0 +1,362 @@
+package dockerauth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	defaultLDAPTimeout       = 10 * time.Second
+	defaultLDAPGroupCacheTTL = 5 * time.Minute
+)
+
+var (
+	ErrLDAPUserNotFound   = errors.New("LDAP user not found")
+	ErrLDAPNoGroupInfo    = errors.New("LDAP group membership unknown, configure bindDN to look it up")
+	ErrLDAPMissingUserDN  = errors.New("LDAP requires either bindDN or userDN")
+	ErrLDAPMultipleUsers  = errors.New("LDAP user filter matched multiple entries")
+	ErrLDAPInvalidCACerts = errors.New("LDAP caCert contains no certificates")
+)
+
+// LDAPConfig configures an LDAPAuthenticator.
+//
+// If BindDN is set users are found by searching BaseDN with UserFilter as the
+// bind user, then authenticated by binding as the found entry. Otherwise users
+// bind directly with the DN built from the UserDN template.
+type LDAPConfig struct {
+	URL                string
+	StartTLS           bool
+	InsecureSkipVerify bool
+	CACert             string
+	Timeout            Duration
+
+	BindDN       string
+	BindPassword string
+	UserDN       string
+	BaseDN       string
+	UserFilter   string
+
+	// Group membership is read from GroupAttribute of the user's entry unless
+	// GroupFilter is set, then groups are found by searching GroupBaseDN.
+	GroupAttribute string
+	GroupBaseDN    string
+	GroupFilter    string
+	GroupCacheTTL  Duration
+
+	// MatchGroupCN also names groups by the CN of their DN. CNs aren't unique
+	// across OUs, so only enable it if anyone able to create a group with a
+	// configured CN is trusted with its permissions.
+	MatchGroupCN bool
+}
+
+type ldapGroupCacheEntry struct {
+	groups  []string
+	expires time.Time
+}
+
+// LDAPAuthenticator is a UserAuthenticator, AccessControlStore and
+// GroupProvider backed by an LDAP or Active Directory server. Users don't have
+// permissions of their own, they're granted through their groups.
+type LDAPAuthenticator struct {
+	config    *LDAPConfig
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	cacheTTL  time.Duration
+
+	m          sync.Mutex
+	groupCache map[string]*ldapGroupCacheEntry
+}
+
+func NewLDAPAuthenticator(c *LDAPConfig) (*LDAPAuthenticator, error) {
+	if c.BindDN == "" && c.UserDN == "" {
+		return nil, ErrLDAPMissingUserDN
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CACert != "" {
+		buf, err := ioutil.ReadFile(c.CACert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(buf) {
+			return nil, ErrLDAPInvalidCACerts
+		}
+	}
+
+	a := &LDAPAuthenticator{
+		config:     c,
+		tlsConfig:  tlsConfig,
+		timeout:    c.Timeout.Duration,
+		cacheTTL:   c.GroupCacheTTL.Duration,
+		groupCache: make(map[string]*ldapGroupCacheEntry),
+	}
+	if a.timeout <= 0 {
+		a.timeout = defaultLDAPTimeout
+	}
+	if a.cacheTTL <= 0 {
+		a.cacheTTL = defaultLDAPGroupCacheTTL
+	}
+	if c.UserFilter == "" {
+		c.UserFilter = "(uid=%s)"
+	}
+	if c.GroupAttribute == "" {
+		c.GroupAttribute = "memberOf"
+	}
+	return a, nil
+}
+
+func (a *LDAPAuthenticator) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.timeout}),
+		ldap.DialWithTLSConfig(a.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(a.timeout)
+
+	if a.config.StartTLS {
+		if err := conn.StartTLS(a.tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (a *LDAPAuthenticator) Login(username, password string) (bool, error) {
+	// An empty password is an unauthenticated bind which always succeeds
+	if username == "" || password == "" {
+		return false, nil
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	var userDN string
+	if a.config.BindDN != "" {
+		if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+			return false, err
+		}
+
+		userDN, err = a.searchUser(conn, username)
+		if err == ErrLDAPUserNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	} else {
+		userDN = fmt.Sprintf(a.config.UserDN, ldap.EscapeDN(username))
+	}
+
+	if err := conn.Bind(userDN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	// Read groups while bound as the user so GetACLS works without a bind user
+	groups, err := a.searchGroups(conn, userDN)
+	if err != nil {
+		return false, err
+	}
+	a.cacheGroups(username, groups)
+
+	return true, nil
+}
+
+// searchUser returns the DN of username.
+func (a *LDAPAuthenticator) searchUser(conn *ldap.Conn, username string) (string, error) {
+	req := ldap.NewSearchRequest(
+		a.config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(a.config.UserFilter, ldap.EscapeFilter(username)),
+		[]string{"1.1"},
+		nil,
+	)
+
+	res, err := conn.Search(req)
+	if err != nil {
+		return "", err
+	}
+
+	switch len(res.Entries) {
+	case 0:
+		return "", ErrLDAPUserNotFound
+	case 1:
+		return res.Entries[0].DN, nil
+	}
+	return "", ErrLDAPMultipleUsers
+}
+
+// searchGroups returns the DNs of the groups userDN is a member of.
+func (a *LDAPAuthenticator) searchGroups(conn *ldap.Conn, userDN string) ([]string, error) {
+	if a.config.GroupFilter == "" {
+		req := ldap.NewSearchRequest(
+			userDN,
+			ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false,
+			"(objectClass=*)",
+			[]string{a.config.GroupAttribute},
+			nil,
+		)
+
+		res, err := conn.Search(req)
+		if err != nil {
+			return nil, err
+		}
+		if len(res.Entries) == 0 {
+			return nil, ErrLDAPUserNotFound
+		}
+		return res.Entries[0].GetAttributeValues(a.config.GroupAttribute), nil
+	}
+
+	req := ldap.NewSearchRequest(
+		a.config.GroupBaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(a.config.GroupFilter, ldap.EscapeFilter(userDN)),
+		[]string{"1.1"},
+		nil,
+	)
+
+	res, err := conn.Search(req)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]string, len(res.Entries))
+	for i, entry := range res.Entries {
+		groups[i] = entry.DN
+	}
+	return groups, nil
+}
+
+func (a *LDAPAuthenticator) cacheGroups(username string, groups []string) {
+	a.m.Lock()
+	a.groupCache[username] = &ldapGroupCacheEntry{
+		groups:  groups,
+		expires: time.Now().Add(a.cacheTTL),
+	}
+	a.m.Unlock()
+}
+
+func (a *LDAPAuthenticator) cachedGroups(username string) ([]string, bool) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	entry, exists := a.groupCache[username]
+	if !exists {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(a.groupCache, username)
+		return nil, false
+	}
+	return entry.groups, true
+}
+
+// GetGroups returns the DN of each group username is a member of, followed by
+// its CN if MatchGroupCN is set. Groups read during Login are reused until
+// they expire, after that the bind user is needed to look them up again.
+func (a *LDAPAuthenticator) GetGroups(username string) ([]string, error) {
+	if groups, ok := a.cachedGroups(username); ok {
+		return ldapGroupNames(groups, a.config.MatchGroupCN), nil
+	}
+
+	if a.config.BindDN == "" {
+		return nil, ErrLDAPNoGroupInfo
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+		return nil, err
+	}
+
+	userDN, err := a.searchUser(conn, username)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := a.searchGroups(conn, userDN)
+	if err != nil {
+		return nil, err
+	}
+	a.cacheGroups(username, groups)
+	return ldapGroupNames(groups, a.config.MatchGroupCN), nil
+}
+
+// GetACLS returns no permissions for users in the directory, they only have
+// those of their groups. Users the directory doesn't know are an error.
+func (a *LDAPAuthenticator) GetACLS(username string) ([]*AccessControl, error) {
+	if _, err := a.GetGroups(username); err != nil {
+		if err == ErrLDAPUserNotFound {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ldapDNEqual reports whether a and b are the same DN. Names which aren't DNs
+// are never equal.
+func ldapDNEqual(a, b string) bool {
+	dnA, err := ldap.ParseDN(a)
+	if err != nil || len(dnA.RDNs) == 0 {
+		return false
+	}
+	dnB, err := ldap.ParseDN(b)
+	if err != nil {
+		return false
+	}
+	return dnA.EqualFold(dnB)
+}
+
+// ldapGroupNames returns each group DN, followed by its CN if withCN is set
+// and it has one.
+func ldapGroupNames(dns []string, withCN bool) []string {
+	names := make([]string, 0, len(dns)*2)
+	for _, group := range dns {
+		names = append(names, group)
+		if !withCN {
+			continue
+		}
+
+		dn, err := ldap.ParseDN(group)
+		if err != nil || len(dn.RDNs) == 0 {
+			continue
+		}
+		for _, attr := range dn.RDNs[0].Attributes {
+			if strings.EqualFold(attr.Type, "cn") {
+				names = append(names, attr.Value)
+			}
+		}
+	}
+	return names
+}
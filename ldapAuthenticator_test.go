@@ -0,0 +1,558 @@
+package dockerauth
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// testLDAPServer is a minimal in-process LDAP server supporting simple binds,
+// searches with and/or/not/equality/present filters, LDAPS and StartTLS.
+type testLDAPServer struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	entries   []*testLDAPEntry
+}
+
+type testLDAPEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+var testLDAPDirectory = []*testLDAPEntry{
+	{
+		dn:       "uid=svc,ou=services,dc=example,dc=com",
+		password: "svcpass",
+		attrs:    map[string][]string{"objectClass": {"account"}, "uid": {"svc"}},
+	},
+	{
+		dn:       "uid=alice,ou=people,dc=example,dc=com",
+		password: "alicepass",
+		attrs: map[string][]string{
+			"objectClass": {"person"},
+			"uid":         {"alice"},
+			"memberOf":    {"cn=devs,ou=groups,dc=example,dc=com", "cn=ops,ou=groups,dc=example,dc=com"},
+		},
+	},
+	{
+		dn:       "uid=bob,ou=people,dc=example,dc=com",
+		password: "bobpass",
+		attrs: map[string][]string{
+			"objectClass": {"person"},
+			"uid":         {"bob"},
+		},
+	},
+	{
+		dn: "cn=devs,ou=groups,dc=example,dc=com",
+		attrs: map[string][]string{
+			"objectClass": {"groupOfNames"},
+			"cn":          {"devs"},
+			"member":      {"uid=alice,ou=people,dc=example,dc=com"},
+		},
+	},
+	{
+		dn: "cn=ops,ou=groups,dc=example,dc=com",
+		attrs: map[string][]string{
+			"objectClass": {"groupOfNames"},
+			"cn":          {"ops"},
+			"member":      {"uid=alice,ou=people,dc=example,dc=com"},
+		},
+	},
+}
+
+var testLDAPGroups = []*GroupConfig{
+	{
+		Name: "devs",
+		Permissions: []*AccessControl{
+			{IP: "*", Name: "dev/**", Actions: []string{"pull", "push"}},
+		},
+	},
+	{
+		// DNs are compared ignoring case, the directory returns them lowercase
+		Name: "CN=Ops,OU=Groups,DC=example,DC=com",
+		Permissions: []*AccessControl{
+			{IP: "*", Name: "**", Actions: []string{"pull"}},
+		},
+	},
+	{
+		Name: "admins",
+		Permissions: []*AccessControl{
+			{IP: "*", Name: "**", Actions: []string{"*"}},
+		},
+	},
+}
+
+// newTestLDAPServer starts a server on localhost. If ldaps is true the listener
+// uses TLS, otherwise TLS is only available through StartTLS. It returns the
+// server and the path to the CA certificate.
+func newTestLDAPServer(t *testing.T, ldaps bool) (*testLDAPServer, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ok(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	ok(t, err)
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	ok(t, os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+
+	s := &testLDAPServer{
+		tlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		},
+		entries: testLDAPDirectory,
+	}
+
+	if ldaps {
+		s.listener, err = tls.Listen("tcp", "127.0.0.1:0", s.tlsConfig)
+	} else {
+		s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	ok(t, err)
+	t.Cleanup(func() { s.listener.Close() })
+
+	go s.serve()
+	return s, caPath
+}
+
+func (s *testLDAPServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *testLDAPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *testLDAPServer) handle(conn net.Conn) {
+	defer func() { conn.Close() }()
+	reader := bufio.NewReader(conn)
+
+	for {
+		packet, err := ber.ReadPacket(reader)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+
+		msgID := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case testLDAPBindRequest:
+			dn := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+
+			code := int64(49) // invalidCredentials
+			if dn == "" && password == "" {
+				code = 0 // Anonymous bind
+			}
+			if entry := s.find(dn); entry != nil && entry.password != "" && entry.password == password {
+				code = 0
+			}
+			conn.Write(testLDAPResult(msgID, testLDAPBindResponse, code).Bytes())
+
+		case testLDAPUnbindRequest:
+			return
+
+		case testLDAPSearchRequest:
+			base := op.Children[0].Data.String()
+			scope := op.Children[1].Value.(int64)
+			filter := op.Children[6]
+
+			var attrs []string
+			for _, attr := range op.Children[7].Children {
+				attrs = append(attrs, attr.Data.String())
+			}
+
+			if scope == 0 && s.find(base) == nil {
+				conn.Write(testLDAPResult(msgID, testLDAPSearchResultDone, 32).Bytes()) // noSuchObject
+				continue
+			}
+
+			for _, entry := range s.entries {
+				if entry.inScope(base, scope) && entry.matches(filter) {
+					conn.Write(entry.searchResult(msgID, attrs).Bytes())
+				}
+			}
+			conn.Write(testLDAPResult(msgID, testLDAPSearchResultDone, 0).Bytes())
+
+		case testLDAPExtendedRequest:
+			if op.Children[0].Data.String() != "1.3.6.1.4.1.1466.20037" {
+				conn.Write(testLDAPResult(msgID, testLDAPExtendedResponse, 2).Bytes()) // protocolError
+				continue
+			}
+
+			conn.Write(testLDAPResult(msgID, testLDAPExtendedResponse, 0).Bytes())
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			reader = bufio.NewReader(conn)
+
+		default:
+			return
+		}
+	}
+}
+
+const (
+	testLDAPBindRequest       = 0
+	testLDAPBindResponse      = 1
+	testLDAPUnbindRequest     = 2
+	testLDAPSearchRequest     = 3
+	testLDAPSearchResultEntry = 4
+	testLDAPSearchResultDone  = 5
+	testLDAPExtendedRequest   = 23
+	testLDAPExtendedResponse  = 24
+)
+
+func testLDAPMessage(msgID int64, op *ber.Packet) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID, "MessageID"))
+	p.AppendChild(op)
+	return p
+}
+
+func testLDAPResult(msgID int64, tag ber.Tag, code int64) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	return testLDAPMessage(msgID, op)
+}
+
+func (s *testLDAPServer) find(dn string) *testLDAPEntry {
+	for _, entry := range s.entries {
+		if strings.EqualFold(entry.dn, dn) {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (e *testLDAPEntry) inScope(base string, scope int64) bool {
+	dn := strings.ToLower(e.dn)
+	base = strings.ToLower(base)
+
+	switch scope {
+	case 0: // baseObject
+		return dn == base
+	case 1: // singleLevel
+		parts := strings.SplitN(dn, ",", 2)
+		return len(parts) == 2 && parts[1] == base
+	}
+	return dn == base || strings.HasSuffix(dn, ","+base)
+}
+
+func (e *testLDAPEntry) values(attr string) []string {
+	for name, values := range e.attrs {
+		if strings.EqualFold(name, attr) {
+			return values
+		}
+	}
+	return nil
+}
+
+func (e *testLDAPEntry) matches(filter *ber.Packet) bool {
+	switch filter.Tag {
+	case 0: // and
+		for _, child := range filter.Children {
+			if !e.matches(child) {
+				return false
+			}
+		}
+		return true
+	case 1: // or
+		for _, child := range filter.Children {
+			if e.matches(child) {
+				return true
+			}
+		}
+		return false
+	case 2: // not
+		return !e.matches(filter.Children[0])
+	case 3: // equalityMatch
+		for _, value := range e.values(filter.Children[0].Data.String()) {
+			if strings.EqualFold(value, filter.Children[1].Data.String()) {
+				return true
+			}
+		}
+		return false
+	case 7: // present
+		attr := filter.Data.String()
+		return strings.EqualFold(attr, "objectClass") || len(e.values(attr)) > 0
+	}
+	return false
+}
+
+func (e *testLDAPEntry) searchResult(msgID int64, attrs []string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, testLDAPSearchResultEntry, nil, "Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "DN"))
+
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for name, values := range e.attrs {
+		if len(attrs) > 0 && !stringInSliceFold(name, attrs) {
+			continue
+		}
+
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		}
+		attr.AppendChild(set)
+		attributes.AppendChild(attr)
+	}
+	op.AppendChild(attributes)
+
+	return testLDAPMessage(msgID, op)
+}
+
+func stringInSliceFold(s string, list []string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLDAPBindAsUser(t *testing.T) {
+	server, _ := newTestLDAPServer(t, false)
+
+	la, err := NewLDAPAuthenticator(&LDAPConfig{
+		URL:    "ldap://" + server.addr(),
+		UserDN: "uid=%s,ou=people,dc=example,dc=com",
+	})
+	ok(t, err)
+
+	login, err := la.Login("alice", "alicepass")
+	ok(t, err)
+	assert(t, login, "Login failed")
+
+	for _, creds := range [][2]string{{"alice", "wrong"}, {"alice", ""}, {"", ""}, {"nobody", "alicepass"}} {
+		login, err = la.Login(creds[0], creds[1])
+		ok(t, err)
+		assert(t, !login, "Login succeeded for %s:%s", creds[0], creds[1])
+	}
+
+	groups, err := la.GetGroups("alice")
+	ok(t, err)
+	equals(t, groups, []string{"cn=devs,ou=groups,dc=example,dc=com", "cn=ops,ou=groups,dc=example,dc=com"})
+
+	// Without a bind user groups are only known after logging in
+	_, err = la.GetGroups("bob")
+	equals(t, err, ErrLDAPNoGroupInfo)
+
+	login, err = la.Login("bob", "bobpass")
+	ok(t, err)
+	assert(t, login, "Login failed")
+
+	groups, err = la.GetGroups("bob")
+	ok(t, err)
+	equals(t, len(groups), 0)
+}
+
+func TestLDAPSearchThenBind(t *testing.T) {
+	server, caPath := newTestLDAPServer(t, true)
+
+	la, err := NewLDAPAuthenticator(&LDAPConfig{
+		URL:          "ldaps://" + server.addr(),
+		CACert:       caPath,
+		BindDN:       "uid=svc,ou=services,dc=example,dc=com",
+		BindPassword: "svcpass",
+		BaseDN:       "ou=people,dc=example,dc=com",
+		UserFilter:   "(&(objectClass=person)(uid=%s))",
+		GroupBaseDN:  "ou=groups,dc=example,dc=com",
+		GroupFilter:  "(&(objectClass=groupOfNames)(member=%s))",
+		MatchGroupCN: true,
+	})
+	ok(t, err)
+
+	login, err := la.Login("alice", "alicepass")
+	ok(t, err)
+	assert(t, login, "Login failed")
+
+	login, err = la.Login("alice", "wrong")
+	ok(t, err)
+	assert(t, !login, "Login succeeded with wrong password")
+
+	// The filter value is escaped
+	login, err = la.Login("*", "alicepass")
+	ok(t, err)
+	assert(t, !login, "Login succeeded with wildcard username")
+
+	// Group lookups use the bind user when nothing is cached
+	la, err = NewLDAPAuthenticator(la.config)
+	ok(t, err)
+	groups, err := la.GetGroups("alice")
+	ok(t, err)
+	equals(t, groups, []string{
+		"cn=devs,ou=groups,dc=example,dc=com", "devs",
+		"cn=ops,ou=groups,dc=example,dc=com", "ops",
+	})
+
+	_, err = la.GetGroups("nobody")
+	equals(t, err, ErrLDAPUserNotFound)
+
+	acls, err := la.GetACLS("alice")
+	ok(t, err)
+	equals(t, len(acls), 0)
+
+	_, err = la.GetACLS("nobody")
+	equals(t, err, ErrUserNotFound)
+}
+
+var ldapDNEqualTests = []struct {
+	a, b     string
+	expected bool
+}{
+	{"cn=devs,ou=groups,dc=example,dc=com", "CN=Devs,OU=Groups,DC=example,DC=com", true},
+	{"cn=devs,ou=groups,dc=example,dc=com", "cn=devs, ou=groups, dc=example, dc=com", true},
+	{"cn=devs,ou=groups,dc=example,dc=com", "cn=devs,ou=other,dc=example,dc=com", false},
+	{"cn=devs,ou=groups,dc=example,dc=com", "devs", false},
+	{"devs", "Devs", false},
+	{"", "", false},
+}
+
+func TestLDAPDNEqual(t *testing.T) {
+	for _, test := range ldapDNEqualTests {
+		equals(t, ldapDNEqual(test.a, test.b), test.expected)
+	}
+}
+
+func TestLDAPGroupPermissions(t *testing.T) {
+	server, _ := newTestLDAPServer(t, false)
+
+	la, err := NewLDAPAuthenticator(&LDAPConfig{
+		URL:          "ldap://" + server.addr(),
+		UserDN:       "uid=%s,ou=people,dc=example,dc=com",
+		MatchGroupCN: true,
+	})
+	ok(t, err)
+
+	config := newTestConfig()
+	config.Group = testLDAPGroups
+	a := NewAuthenticator(&Options{
+		Config:             config,
+		UserAuthenticator:  la,
+		AccessControlStore: la,
+	})
+
+	req := httptest.NewRequest("GET", "/api/auth?service=localhost:5000&scope=repository:dev/app:push,pull", nil)
+	req.SetBasicAuth("alice", "alicepass")
+
+	token, err := a.GetToken("alice", "alicepass", req)
+	ok(t, err)
+	claims := decodeTestToken(t, token)
+	equals(t, claims.Access[0].Actions, []string{"pull", "push"})
+
+	// Groups are matched by DN as well as CN
+	acls, err := a.getACLS(a.getConfig(), testRegistry(a), "alice")
+	ok(t, err)
+	equals(t, acls, []*AccessControl{testLDAPGroups[0].Permissions[0], testLDAPGroups[1].Permissions[0]})
+
+	// Only by DN unless CN matching is enabled
+	la.config.MatchGroupCN = false
+	acls, err = a.getACLS(a.getConfig(), testRegistry(a), "alice")
+	ok(t, err)
+	equals(t, acls, []*AccessControl{testLDAPGroups[1].Permissions[0]})
+}
+
+func TestLDAPExpiredGroups(t *testing.T) {
+	server, _ := newTestLDAPServer(t, false)
+
+	la, err := NewLDAPAuthenticator(&LDAPConfig{
+		URL:    "ldap://" + server.addr(),
+		UserDN: "uid=%s,ou=people,dc=example,dc=com",
+	})
+	ok(t, err)
+	cache, err := NewCachingAuthenticator(la, time.Hour)
+	ok(t, err)
+
+	config := newTestConfig()
+	config.Group = testLDAPGroups
+	a := NewAuthenticator(&Options{
+		Config:             config,
+		UserAuthenticator:  cache,
+		AccessControlStore: la,
+	})
+
+	req := httptest.NewRequest("GET", "/api/auth?service=localhost:5000&scope=repository:dev/app:pull", nil)
+	_, err = a.GetToken("alice", "alicepass", req)
+	ok(t, err)
+	refreshToken, err := a.GenerateRefreshToken("localhost:5000", "alice", "test-client")
+	ok(t, err)
+
+	// Without a bind user expired groups need a password login to be read
+	// again, the cached credentials and refresh tokens are refused instead
+	la.groupCache["alice"].expires = time.Time{}
+	_, err = a.validateRefreshToken(testRegistry(a), refreshToken)
+	equals(t, err, ErrInvalidRefreshToken)
+
+	_, err = a.GetToken("alice", "alicepass", req)
+	equals(t, err, ErrInvalidLogin)
+
+	_, err = a.GetToken("alice", "alicepass", req)
+	ok(t, err)
+}
+
+func TestLDAPStartTLS(t *testing.T) {
+	server, caPath := newTestLDAPServer(t, false)
+
+	la, err := NewLDAPAuthenticator(&LDAPConfig{
+		URL:      "ldap://" + server.addr(),
+		StartTLS: true,
+		CACert:   caPath,
+		UserDN:   "uid=%s,ou=people,dc=example,dc=com",
+	})
+	ok(t, err)
+
+	login, err := la.Login("alice", "alicepass")
+	ok(t, err)
+	assert(t, login, "Login failed")
+
+	// Untrusted server certificate
+	la, err = NewLDAPAuthenticator(&LDAPConfig{
+		URL:      "ldap://" + server.addr(),
+		StartTLS: true,
+		UserDN:   "uid=%s,ou=people,dc=example,dc=com",
+	})
+	ok(t, err)
+
+	_, err = la.Login("alice", "alicepass")
+	assert(t, err != nil, "Expected certificate verification error")
+}
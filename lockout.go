@@ -0,0 +1,215 @@
+package dockerauth
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLockoutMaxAttempts   = 5
+	defaultLockoutIPMaxAttempts = 20
+	defaultLockoutBackoff       = time.Second
+	defaultLockoutMaxBackoff    = 15 * time.Minute
+	defaultLockoutWindow        = time.Hour
+)
+
+var ErrTooManyAttempts = errors.New("Too many failed login attempts")
+
+// LockoutError is returned by a LockoutAuthenticator when a login is refused
+// because of earlier failures, wrapping ErrTooManyAttempts, or when a failed
+// login starts a lockout, wrapping ErrInvalidLogin. RetryAfter is how long
+// until logins are accepted again.
+type LockoutError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *LockoutError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", e.Err, e.RetryAfter)
+}
+
+func (e *LockoutError) Unwrap() error {
+	return e.Err
+}
+
+// LockoutConfig configures failed login tracking. After MaxAttempts failures
+// for a username, or IPMaxAttempts from an IP address, logins are refused for
+// Backoff. The lockout doubles with each further failure up to MaxBackoff.
+// Failures are forgotten once there hasn't been one for Window.
+type LockoutConfig struct {
+	Enabled       bool
+	MaxAttempts   int
+	IPMaxAttempts int
+	Backoff       Duration
+	MaxBackoff    Duration
+	Window        Duration
+}
+
+// lockoutEntry counts the failed logins of a username or IP address.
+type lockoutEntry struct {
+	failures int
+	last     time.Time
+	until    time.Time
+}
+
+// LockoutAuthenticator wraps a UserAuthenticator to refuse logins for users
+// and IP addresses with too many failed logins. Refused logins aren't checked
+// against the wrapped UserAuthenticator so expensive password hashes can't be
+// used to overload the server.
+type LockoutAuthenticator struct {
+	ua            UserAuthenticator
+	maxAttempts   int
+	ipMaxAttempts int
+	backoff       time.Duration
+	maxBackoff    time.Duration
+	window        time.Duration
+	now           func() time.Time
+
+	m         sync.Mutex
+	users     map[string]*lockoutEntry
+	ips       map[string]*lockoutEntry
+	lastPrune time.Time
+}
+
+// NewLockoutAuthenticator wraps ua. Unset limits in c use the defaults.
+func NewLockoutAuthenticator(ua UserAuthenticator, c *LockoutConfig) *LockoutAuthenticator {
+	if c == nil {
+		c = &LockoutConfig{}
+	}
+
+	l := &LockoutAuthenticator{
+		ua:            ua,
+		maxAttempts:   c.MaxAttempts,
+		ipMaxAttempts: c.IPMaxAttempts,
+		backoff:       c.Backoff.Duration,
+		maxBackoff:    c.MaxBackoff.Duration,
+		window:        c.Window.Duration,
+		now:           time.Now,
+		users:         make(map[string]*lockoutEntry),
+		ips:           make(map[string]*lockoutEntry),
+	}
+	if l.maxAttempts <= 0 {
+		l.maxAttempts = defaultLockoutMaxAttempts
+	}
+	if l.ipMaxAttempts <= 0 {
+		l.ipMaxAttempts = defaultLockoutIPMaxAttempts
+	}
+	if l.backoff <= 0 {
+		l.backoff = defaultLockoutBackoff
+	}
+	if l.maxBackoff <= 0 {
+		l.maxBackoff = defaultLockoutMaxBackoff
+	}
+	if l.window <= 0 {
+		l.window = defaultLockoutWindow
+	}
+	return l
+}
+
+// Login checks the credentials of username without tracking the client's IP
+// address.
+func (l *LockoutAuthenticator) Login(username, password string) (bool, error) {
+	return l.LoginFromIP(username, password, "")
+}
+
+// LoginFromIP checks the credentials of username logging in from ip unless
+// either is locked out.
+func (l *LockoutAuthenticator) LoginFromIP(username, password, ip string) (bool, error) {
+	if wait := l.lockedFor(username, ip); wait > 0 {
+		return false, &LockoutError{Err: ErrTooManyAttempts, RetryAfter: wait}
+	}
+
+	ok, err := l.ua.Login(username, password)
+	if err != nil {
+		return false, err
+	}
+
+	if ok {
+		l.m.Lock()
+		delete(l.users, username)
+		l.m.Unlock()
+		return true, nil
+	}
+
+	if wait := l.failed(username, ip); wait > 0 {
+		return false, &LockoutError{Err: ErrInvalidLogin, RetryAfter: wait}
+	}
+	return false, nil
+}
+
+// lockedFor returns how long username or ip is still locked out for.
+func (l *LockoutAuthenticator) lockedFor(username, ip string) time.Duration {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := l.now()
+	var wait time.Duration
+	if e := l.users[username]; e != nil && e.until.After(now) {
+		wait = e.until.Sub(now)
+	}
+	if e := l.ips[ip]; ip != "" && e != nil && e.until.Sub(now) > wait {
+		wait = e.until.Sub(now)
+	}
+	return wait
+}
+
+// failed records a failed login and returns how long username or ip is now
+// locked out for.
+func (l *LockoutAuthenticator) failed(username, ip string) time.Duration {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	wait := l.recordFailure(l.users, username, l.maxAttempts, now)
+	if ip != "" {
+		if ipWait := l.recordFailure(l.ips, ip, l.ipMaxAttempts, now); ipWait > wait {
+			wait = ipWait
+		}
+	}
+	return wait
+}
+
+func (l *LockoutAuthenticator) recordFailure(entries map[string]*lockoutEntry, key string, maxAttempts int, now time.Time) time.Duration {
+	e := entries[key]
+	if e == nil || now.Sub(e.last) > l.window {
+		e = &lockoutEntry{}
+		entries[key] = e
+	}
+	e.failures++
+	e.last = now
+
+	if e.failures < maxAttempts {
+		return 0
+	}
+
+	wait := l.backoff
+	for i := maxAttempts; i < e.failures && wait < l.maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > l.maxBackoff {
+		wait = l.maxBackoff
+	}
+	e.until = now.Add(wait)
+	return wait
+}
+
+// prune forgets failures older than the window at most once per window so
+// the maps don't grow without bound.
+func (l *LockoutAuthenticator) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < l.window {
+		return
+	}
+	l.lastPrune = now
+
+	for _, entries := range []map[string]*lockoutEntry{l.users, l.ips} {
+		for key, e := range entries {
+			if now.Sub(e.last) > l.window && !e.until.After(now) {
+				delete(entries, key)
+			}
+		}
+	}
+}
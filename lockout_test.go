@@ -0,0 +1,133 @@
+package dockerauth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// countingAuthenticator accepts the password "testing" and counts logins.
+type countingAuthenticator struct {
+	logins int
+}
+
+func (c *countingAuthenticator) Login(username, password string) (bool, error) {
+	c.logins++
+	return password == "testing", nil
+}
+
+func newTestLockout(ua UserAuthenticator, now *time.Time) *LockoutAuthenticator {
+	l := NewLockoutAuthenticator(ua, &LockoutConfig{
+		MaxAttempts:   3,
+		IPMaxAttempts: 5,
+		Backoff:       Duration{time.Second},
+		MaxBackoff:    Duration{5 * time.Second},
+		Window:        Duration{time.Minute},
+	})
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func retryAfter(err error) time.Duration {
+	var lockout *LockoutError
+	if !errors.As(err, &lockout) {
+		return 0
+	}
+	return lockout.RetryAfter
+}
+
+func TestLockoutUsername(t *testing.T) {
+	now := time.Now()
+	ua := &countingAuthenticator{}
+	l := newTestLockout(ua, &now)
+
+	for i := 0; i < 2; i++ {
+		loggedIn, err := l.LoginFromIP("test", "wrong", "10.0.0.1")
+		ok(t, err)
+		assert(t, !loggedIn, "Wrong password was accepted")
+	}
+
+	// The third failure starts the lockout
+	_, err := l.LoginFromIP("test", "wrong", "10.0.0.2")
+	assert(t, errors.Is(err, ErrInvalidLogin), "Expected invalid login, got %v", err)
+	equals(t, retryAfter(err), time.Second)
+
+	// Locked out logins aren't checked, even with the right password
+	_, err = l.LoginFromIP("test", "testing", "10.0.0.3")
+	assert(t, errors.Is(err, ErrTooManyAttempts), "Expected too many attempts, got %v", err)
+	equals(t, ua.logins, 3)
+
+	// Other users aren't affected
+	loggedIn, err := l.LoginFromIP("other", "testing", "10.0.0.3")
+	ok(t, err)
+	assert(t, loggedIn, "Other user was locked out")
+
+	// The lockout doubles with each failure up to the maximum
+	for _, expected := range []time.Duration{2 * time.Second, 4 * time.Second, 5 * time.Second} {
+		now = now.Add(retryAfter(err) + time.Second)
+		_, err = l.LoginFromIP("test", "wrong", "10.0.0.4")
+		equals(t, retryAfter(err), expected)
+	}
+
+	// A successful login clears the failures
+	now = now.Add(5 * time.Second)
+	loggedIn, err = l.LoginFromIP("test", "testing", "10.0.0.4")
+	ok(t, err)
+	assert(t, loggedIn, "Login failed after the lockout")
+	_, err = l.LoginFromIP("test", "wrong", "10.0.0.4")
+	ok(t, err)
+}
+
+func TestLockoutIP(t *testing.T) {
+	now := time.Now()
+	l := newTestLockout(&countingAuthenticator{}, &now)
+
+	var err error
+	for i := 0; i < 5; i++ {
+		_, err = l.LoginFromIP("user"+string(rune('a'+i)), "wrong", "10.0.0.1")
+	}
+	equals(t, retryAfter(err), time.Second)
+
+	_, err = l.LoginFromIP("test", "testing", "10.0.0.1")
+	assert(t, errors.Is(err, ErrTooManyAttempts), "Expected too many attempts, got %v", err)
+
+	loggedIn, err := l.LoginFromIP("test", "testing", "10.0.0.2")
+	ok(t, err)
+	assert(t, loggedIn, "Other IP was locked out")
+
+	// Failures are forgotten after the window
+	now = now.Add(2 * time.Minute)
+	_, err = l.LoginFromIP("usera", "wrong", "10.0.0.1")
+	ok(t, err)
+}
+
+func TestLockoutConfig(t *testing.T) {
+	c, err := LoadConfig("testdata/config.toml")
+	ok(t, err)
+	equals(t, c.Lockout.MaxAttempts, 5)
+	equals(t, c.Lockout.IPMaxAttempts, 20)
+	equals(t, c.Lockout.MaxBackoff.Duration, 15*time.Minute)
+}
+
+func TestLockoutAuthenticator(t *testing.T) {
+	fa, err := NewFileAuthenticator("testdata/accounts.toml")
+	ok(t, err)
+	a := NewAuthenticator(&Options{
+		Config:             newTestConfig(),
+		UserAuthenticator:  NewLockoutAuthenticator(fa, &LockoutConfig{MaxAttempts: 1}),
+		AccessControlStore: fa,
+	})
+	assert(t, a != nil, "Authenticator wasn't created")
+
+	r := httptest.NewRequest("GET", "/api/auth?service=localhost:5000", nil)
+	r.RemoteAddr = "127.0.0.1"
+	r.SetBasicAuth("test", "wrong")
+	err = a.ProcessRequest(httptest.NewRecorder(), r)
+	assert(t, errors.Is(err, ErrInvalidLogin), "Expected invalid login, got %v", err)
+
+	r.SetBasicAuth("test", "testing")
+	err = a.ProcessRequest(httptest.NewRecorder(), r)
+	assert(t, errors.Is(err, ErrTooManyAttempts), "Expected too many attempts, got %v", err)
+	equals(t, tokenOutcome(&AuditEvent{}, err), outcomeLockedOut)
+}
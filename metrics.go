@@ -0,0 +1,309 @@
+package dockerauth
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MetricsPath = "/metrics"
+
+// Token request outcomes counted by the docker_auth_token_requests_total
+// metric.
+const (
+	outcomeGranted        = "granted"
+	outcomePartial        = "partially_granted"
+	outcomeDenied         = "denied"
+	outcomeInvalidLogin   = "invalid_login"
+	outcomeLockedOut      = "locked_out"
+	outcomeUnknownService = "unknown_service"
+	outcomeInvalidScope   = "invalid_scope"
+	outcomeError          = "error"
+)
+
+// latencyBuckets are the upper bounds in seconds of the latency histograms.
+var latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// userStatsTTL is how long gauges read from the user store are cached. Changes
+// made outside the admin API, such as directly in an SQL database, show up
+// after this.
+const userStatsTTL = time.Minute
+
+// metrics are the counters and histograms of an Authenticator. Gauges are
+// read from the configuration when the metrics are requested, and from the
+// user store at most every userStatsTTL.
+type metrics struct {
+	tokenRequests *counterVec
+	loginDuration *histogram
+	signDuration  *histogram
+
+	m         sync.Mutex
+	userStats *userStats
+}
+
+// userStats are the gauges read from the user store.
+type userStats struct {
+	users   int
+	rules   int
+	expires time.Time
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		tokenRequests: newCounterVec(outcomeGranted, outcomePartial, outcomeDenied,
+			outcomeInvalidLogin, outcomeLockedOut, outcomeUnknownService, outcomeInvalidScope, outcomeError),
+		loginDuration: newHistogram(latencyBuckets),
+		signDuration:  newHistogram(latencyBuckets),
+	}
+}
+
+// observeSign records the time taken to sign a token since start.
+func (m *metrics) observeSign(start time.Time) {
+	if m != nil {
+		m.signDuration.observe(time.Since(start).Seconds())
+	}
+}
+
+// tokenOutcome classifies a token request by its error, or if it succeeded
+// by how much of the requested access was granted.
+func tokenOutcome(event *AuditEvent, err error) string {
+	switch {
+	case errors.Is(err, ErrInvalidLogin):
+		return outcomeInvalidLogin
+	case errors.Is(err, ErrTooManyAttempts):
+		return outcomeLockedOut
+	case errors.Is(err, ErrUnknownService):
+		return outcomeUnknownService
+	case errors.Is(err, ErrInvalidScope):
+		return outcomeInvalidScope
+	case err != nil:
+		return outcomeError
+	}
+
+	granted, denied := false, false
+	for _, scope := range event.Scopes {
+		if len(scope.Granted) > 0 {
+			granted = true
+		}
+		if scope.Denied != "" {
+			denied = true
+		}
+	}
+
+	switch {
+	case !denied:
+		return outcomeGranted
+	case granted:
+		return outcomePartial
+	default:
+		return outcomeDenied
+	}
+}
+
+// userLogin checks credentials with the UserAuthenticator, timing how long it
+// takes. The client's IP address is passed on if the UserAuthenticator uses
+// it.
+func (a *Authenticator) userLogin(username, password, clientIP string) (bool, error) {
+	start := time.Now()
+	defer func() { a.metrics.loginDuration.observe(time.Since(start).Seconds()) }()
+
+	if ua, ok := a.userAuthenticator.(IPUserAuthenticator); ok {
+		return ua.LoginFromIP(username, password, clientIP)
+	}
+	return a.userAuthenticator.Login(username, password)
+}
+
+// getUserStats returns the cached user store gauges, listing the users again
+// if they've expired.
+func (m *metrics) getUserStats(store UserStore) (*userStats, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	if m.userStats != nil && time.Now().Before(m.userStats.expires) {
+		return m.userStats, nil
+	}
+
+	users, err := store.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &userStats{users: len(users), expires: time.Now().Add(userStatsTTL)}
+	for _, user := range users {
+		stats.rules += len(user.Permissions)
+	}
+	m.userStats = stats
+	return stats, nil
+}
+
+// resetUserStats makes the next metrics request read the user store again.
+func (m *metrics) resetUserStats() {
+	m.m.Lock()
+	m.userStats = nil
+	m.m.Unlock()
+}
+
+// recordTokenRequest counts a finished token request and writes it to the
+// audit log.
+func (a *Authenticator) recordTokenRequest(event *AuditEvent, err error) {
+	a.metrics.tokenRequests.inc(tokenOutcome(event, err))
+	a.audit(event, err)
+}
+
+// ProcessMetricsRequest writes the server's metrics in the Prometheus text
+// exposition format.
+func (a *Authenticator) ProcessMetricsRequest(w http.ResponseWriter, r *http.Request) error {
+	c := a.getConfig()
+
+	var buf strings.Builder
+	writeMetricHeader(&buf, "docker_auth_token_requests_total", "counter", "Token requests by outcome.")
+	a.metrics.tokenRequests.write(&buf, "docker_auth_token_requests_total", "outcome")
+
+	writeMetricHeader(&buf, "docker_auth_login_duration_seconds", "histogram", "Time taken to check user credentials.")
+	a.metrics.loginDuration.write(&buf, "docker_auth_login_duration_seconds")
+
+	writeMetricHeader(&buf, "docker_auth_sign_duration_seconds", "histogram", "Time taken to create and sign tokens.")
+	a.metrics.signDuration.write(&buf, "docker_auth_sign_duration_seconds")
+
+	rules := 0
+	for _, group := range c.Group {
+		rules += len(group.Permissions)
+	}
+	for _, reg := range c.registries {
+		rules += len(reg.Anonymous.Permissions)
+	}
+
+	// Without the user store's gauges the rule count would be wrong, so both
+	// are left out while it fails
+	storeOK := true
+	if store, ok := a.accessControlStore.(UserStore); ok {
+		stats, err := a.metrics.getUserStats(store)
+		if err != nil {
+			a.log.Errorf("Reading users for metrics failed: %s\n", err)
+			storeOK = false
+		} else {
+			rules += stats.rules
+			writeMetricHeader(&buf, "docker_auth_users", "gauge", "Users in the user store.")
+			fmt.Fprintf(&buf, "docker_auth_users %d\n", stats.users)
+		}
+	}
+
+	if storeOK {
+		writeMetricHeader(&buf, "docker_auth_rules", "gauge", "Permissions of users, groups and anonymous access.")
+		fmt.Fprintf(&buf, "docker_auth_rules %d\n", rules)
+	}
+
+	writeMetricHeader(&buf, "docker_auth_signing_key_expiry_timestamp_seconds", "gauge",
+		"Expiry of the certificates of signing keys as a Unix timestamp.")
+	for _, reg := range c.registries {
+		for _, key := range reg.keys.keys {
+			if key.cert == nil {
+				continue
+			}
+			fmt.Fprintf(&buf, "docker_auth_signing_key_expiry_timestamp_seconds{service=%s,kid=%s,state=%s} %d\n",
+				quoteLabel(reg.Name), quoteLabel(key.KeyID()), quoteLabel(key.state), key.cert.NotAfter.Unix())
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// quoteLabel quotes a label value with the escaping the text format uses.
+func quoteLabel(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// counterVec is a set of counters distinguished by one label.
+type counterVec struct {
+	m      sync.Mutex
+	values map[string]uint64
+}
+
+// newCounterVec creates a counterVec reporting labels even before they're
+// counted.
+func newCounterVec(labels ...string) *counterVec {
+	c := &counterVec{values: make(map[string]uint64, len(labels))}
+	for _, label := range labels {
+		c.values[label] = 0
+	}
+	return c
+}
+
+func (c *counterVec) inc(label string) {
+	c.m.Lock()
+	c.values[label]++
+	c.m.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer, name, labelName string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	labels := make([]string, 0, len(c.values))
+	for label := range c.values {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	for _, label := range labels {
+		fmt.Fprintf(w, "%s{%s=%s} %d\n", name, labelName, quoteLabel(label), c.values[label])
+	}
+}
+
+// histogram counts observations in cumulative buckets.
+type histogram struct {
+	m       sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name string) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=%s} %d\n", name, quoteLabel(formatFloat(bound)), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
@@ -0,0 +1,119 @@
+package dockerauth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var tokenOutcomeTests = []struct {
+	scopes   []*AuditScope
+	err      error
+	expected string
+}{
+	{nil, nil, outcomeGranted},
+	{[]*AuditScope{{Granted: []string{"pull"}}}, nil, outcomeGranted},
+	{[]*AuditScope{{Granted: []string{"pull"}}, {Granted: []string{}, Denied: auditNoMatchingRule}}, nil, outcomePartial},
+	{[]*AuditScope{{Granted: []string{}, Denied: auditIPNotAllowed}}, nil, outcomeDenied},
+	{nil, ErrInvalidLogin, outcomeInvalidLogin},
+	{nil, ErrUnknownService, outcomeUnknownService},
+	{nil, ErrInvalidScope, outcomeInvalidScope},
+	{nil, ErrInvalidRefreshToken, outcomeError},
+}
+
+func TestTokenOutcome(t *testing.T) {
+	for _, test := range tokenOutcomeTests {
+		equals(t, tokenOutcome(&AuditEvent{Scopes: test.scopes}, test.err), test.expected)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	fa, err := NewFileAuthenticator("testdata/accounts.toml")
+	ok(t, err)
+	config := newTestConfig()
+	config.Registry[0].Auth.Keys = []*KeyConfig{{Path: "testdata/auth.key", Cert: "testdata/auth.cert"}}
+	a := NewAuthenticator(&Options{
+		Config:             config,
+		UserAuthenticator:  fa,
+		AccessControlStore: fa,
+	})
+	assert(t, a != nil, "Authenticator wasn't created")
+
+	for _, scope := range []string{"repository:testing/app:pull", "repository:unknown:push"} {
+		r := httptest.NewRequest("GET", "/api/auth?service=localhost:5000&scope="+scope, nil)
+		r.SetBasicAuth("test", "testing")
+		ok(t, a.ProcessRequest(httptest.NewRecorder(), r))
+	}
+	r := httptest.NewRequest("GET", "/api/auth?service=localhost:5000", nil)
+	r.SetBasicAuth("test", "wrong")
+	equals(t, a.ProcessRequest(httptest.NewRecorder(), r), ErrInvalidLogin)
+
+	w := httptest.NewRecorder()
+	ok(t, a.ProcessMetricsRequest(w, httptest.NewRequest("GET", MetricsPath, nil)))
+	equals(t, w.Header().Get("Content-Type"), "text/plain; version=0.0.4; charset=utf-8")
+
+	metrics := w.Body.String()
+	for _, line := range []string{
+		"# TYPE docker_auth_token_requests_total counter",
+		`docker_auth_token_requests_total{outcome="granted"} 1`,
+		`docker_auth_token_requests_total{outcome="denied"} 1`,
+		`docker_auth_token_requests_total{outcome="invalid_login"} 1`,
+		`docker_auth_token_requests_total{outcome="unknown_service"} 0`,
+		"# TYPE docker_auth_login_duration_seconds histogram",
+		`docker_auth_login_duration_seconds_bucket{le="+Inf"} 3`,
+		"docker_auth_login_duration_seconds_count 3",
+		"docker_auth_sign_duration_seconds_count 2",
+		"docker_auth_users 2",
+		"docker_auth_rules 5",
+		`docker_auth_signing_key_expiry_timestamp_seconds{service="localhost:5000",kid="` + privKeyID + `",state="active"}`,
+	} {
+		assert(t, strings.Contains(metrics, line), "Metrics are missing %q:\n%s", line, metrics)
+	}
+}
+
+// failingUserStore is a FileAuthenticator whose users can't be listed while
+// err is set.
+type failingUserStore struct {
+	*FileAuthenticator
+	err   error
+	lists int
+}
+
+func (s *failingUserStore) ListUsers() ([]*UserConfig, error) {
+	s.lists++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.FileAuthenticator.ListUsers()
+}
+
+func TestMetricsUserStats(t *testing.T) {
+	fa, err := NewFileAuthenticator("testdata/accounts.toml")
+	ok(t, err)
+	store := &failingUserStore{FileAuthenticator: fa}
+	a := NewAuthenticator(&Options{
+		Config:             newTestConfig(),
+		UserAuthenticator:  store,
+		AccessControlStore: store,
+	})
+
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		ok(t, a.ProcessMetricsRequest(w, httptest.NewRequest("GET", MetricsPath, nil)))
+		return w.Body.String()
+	}
+
+	// Users are only listed again after a reload
+	scrape()
+	assert(t, strings.Contains(scrape(), "docker_auth_users 2"), "Missing user count")
+	equals(t, store.lists, 1)
+
+	a.FlushCredentials()
+	store.err = errors.New("database is down")
+	metrics := scrape()
+	equals(t, store.lists, 2)
+	assert(t, strings.Contains(metrics, `docker_auth_token_requests_total{outcome="granted"} 0`), "Missing counters:\n%s", metrics)
+	assert(t, !strings.Contains(metrics, "docker_auth_users"), "Unexpected user count:\n%s", metrics)
+	assert(t, !strings.Contains(metrics, "docker_auth_rules"), "Unexpected rule count:\n%s", metrics)
+}
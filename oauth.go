@@ -0,0 +1,281 @@
+package dockerauth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMethodNotAllowed     = errors.New("Method not allowed")
+	ErrMissingClientID      = errors.New("Missing client_id")
+	ErrUnsupportedGrantType = errors.New("Unsupported grant_type")
+	ErrInvalidRefreshToken  = errors.New("Invalid refresh token")
+)
+
+const refreshTokenType = "refresh_token"
+
+// refreshTokenAudience is appended to the registry name for the audience of
+// refresh tokens. They're signed with the same keys as access tokens, so the
+// registry would accept them as bearer tokens if the audience was its name.
+const refreshTokenAudience = "#refresh"
+
+// RefreshTokenStore keeps track of refresh tokens that are no longer valid.
+type RefreshTokenStore interface {
+	Revoke(id string) error
+	IsRevoked(id string) (bool, error)
+}
+
+// MemoryRefreshTokenStore is a RefreshTokenStore that keeps revoked token IDs
+// in memory. Revocations are lost when the process exits, so a revoked token
+// is accepted again after a restart until it expires.
+type MemoryRefreshTokenStore struct {
+	m       sync.RWMutex
+	revoked map[string]bool
+}
+
+func NewMemoryRefreshTokenStore() *MemoryRefreshTokenStore {
+	return &MemoryRefreshTokenStore{
+		revoked: make(map[string]bool),
+	}
+}
+
+func (s *MemoryRefreshTokenStore) Revoke(id string) error {
+	s.m.Lock()
+	s.revoked[id] = true
+	s.m.Unlock()
+	return nil
+}
+
+func (s *MemoryRefreshTokenStore) IsRevoked(id string) (bool, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.revoked[id], nil
+}
+
+type refreshTokenPayload struct {
+	Iss      string `json:"iss"`
+	Aud      string `json:"aud"`
+	Sub      string `json:"sub"`
+	Iat      int64  `json:"iat"`
+	Exp      int64  `json:"exp"`
+	Jti      string `json:"jti"`
+	Typ      string `json:"typ"`
+	ClientID string `json:"client_id,omitempty"`
+}
+
+// GenerateRefreshToken creates a signed refresh token for username on the
+// registry named service. The token carries no access claims, permissions are
+// evaluated each time it's used.
+func (a *Authenticator) GenerateRefreshToken(service, username, clientID string) (string, error) {
+	reg, err := a.getConfig().getRegistry(service)
+	if err != nil {
+		return "", err
+	}
+	return generateRefreshToken(reg, username, clientID)
+}
+
+func generateRefreshToken(reg *registry, username, clientID string) (string, error) {
+	signer := reg.keys.Active()
+	header := newJWTHeader(signer)
+
+	now := time.Now()
+	payload := &refreshTokenPayload{
+		Iss:      reg.Auth.Issuer,
+		Aud:      reg.Name + refreshTokenAudience,
+		Sub:      username,
+		Iat:      now.Unix(),
+		Exp:      now.Add(reg.refreshTokenTTL()).Unix(),
+		Typ:      refreshTokenType,
+		ClientID: clientID,
+	}
+
+	uuid, err := generateUUID()
+	if err != nil {
+		return "", err
+	}
+	payload.Jti = uuid
+
+	defer reg.metrics.observeSign(time.Now())
+	return encodeJWT(header, payload, signer)
+}
+
+func parseRefreshToken(keys *KeySet, token string) (*refreshTokenPayload, error) {
+	payload := &refreshTokenPayload{}
+	if err := decodeJWT(token, payload, keys); err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if payload.Typ != refreshTokenType || payload.Jti == "" || payload.Sub == "" {
+		return nil, ErrInvalidRefreshToken
+	}
+	if time.Now().Unix() >= payload.Exp {
+		return nil, ErrInvalidRefreshToken
+	}
+	return payload, nil
+}
+
+// validateRefreshToken checks a refresh token is valid for reg and returns the
+// user it was issued to.
+func (a *Authenticator) validateRefreshToken(reg *registry, token string) (string, error) {
+	payload, err := parseRefreshToken(reg.keys, token)
+	if err != nil {
+		return "", err
+	}
+
+	if payload.Aud != reg.Name+refreshTokenAudience || payload.Iss != reg.Auth.Issuer {
+		return "", ErrInvalidRefreshToken
+	}
+
+	revoked, err := a.refreshTokenStore.IsRevoked(payload.Jti)
+	if err != nil {
+		return "", err
+	}
+	if revoked {
+		return "", ErrInvalidRefreshToken
+	}
+
+	if err := a.checkUserExists(payload.Sub); err != nil {
+		return "", err
+	}
+	return payload.Sub, nil
+}
+
+// checkUserExists checks the user a refresh token was issued to is still
+// known to the store, so deleted users can't keep getting tokens. Stores
+// which only know a user's groups after a password login, such as LDAP
+// without a bind user, reject the token so the client logs in again.
+func (a *Authenticator) checkUserExists(username string) error {
+	var err error
+	if store, ok := a.accessControlStore.(UserStore); ok {
+		_, err = store.GetUser(username)
+	} else {
+		_, err = a.accessControlStore.GetACLS(username)
+	}
+	if errors.Is(err, ErrUserNotFound) || errors.Is(err, ErrLDAPNoGroupInfo) {
+		return ErrInvalidRefreshToken
+	}
+	return err
+}
+
+// RevokeRefreshToken marks a refresh token issued for any registry as revoked
+// so it can no longer be exchanged for access tokens.
+func (a *Authenticator) RevokeRefreshToken(token string) error {
+	for _, reg := range a.getConfig().registries {
+		payload, err := parseRefreshToken(reg.keys, token)
+		if err == nil && payload.Aud == reg.Name+refreshTokenAudience {
+			return a.refreshTokenStore.Revoke(payload.Jti)
+		}
+	}
+	return ErrInvalidRefreshToken
+}
+
+// ProcessOAuthRequest implements the OAuth2 token endpoint supporting the
+// password and refresh_token grant types.
+func (a *Authenticator) ProcessOAuthRequest(w http.ResponseWriter, r *http.Request) (err error) {
+	c := a.getConfig()
+	event := newAuditEvent(c, r, "", "")
+	defer func() { a.recordTokenRequest(event, err) }()
+
+	if r.Method != http.MethodPost {
+		return ErrMethodNotAllowed
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidRequest, err)
+	}
+
+	event.Service = r.PostForm.Get("service")
+	reg, err := c.getRegistry(event.Service)
+	if err != nil {
+		return err
+	}
+
+	clientID := r.PostForm.Get("client_id")
+	if clientID == "" {
+		return ErrMissingClientID
+	}
+
+	grantType := r.PostForm.Get("grant_type")
+	var username, refreshToken string
+
+	switch grantType {
+	case "password":
+		username = r.PostForm.Get("username")
+		event.Username = username
+		a.log.Printf("OAuth token request: client_id=%s, grant_type=%s, user=%s\n", clientID, grantType, username)
+
+		ok, err := a.userLogin(username, r.PostForm.Get("password"), event.ClientIP)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrInvalidLogin
+		}
+
+		if r.PostForm.Get("access_type") == "offline" {
+			refreshToken, err = generateRefreshToken(reg, username, clientID)
+			if err != nil {
+				return err
+			}
+		}
+	case "refresh_token":
+		refreshToken = r.PostForm.Get("refresh_token")
+
+		username, err = a.validateRefreshToken(reg, refreshToken)
+		if err != nil {
+			return err
+		}
+		event.Username = username
+		a.log.Printf("OAuth token request: client_id=%s, grant_type=%s, user=%s\n", clientID, grantType, username)
+	default:
+		return ErrUnsupportedGrantType
+	}
+
+	scopes := strings.Fields(r.PostForm.Get("scope"))
+	access, err := a.authorizeScopes(c, reg, event, username, scopes, r)
+	if err != nil {
+		return err
+	}
+
+	ttl, err := a.tokenTTL(reg, username, access)
+	if err != nil {
+		return err
+	}
+
+	token, claims, err := generateToken(reg, username, access, ttl)
+	if err != nil {
+		return err
+	}
+	event.TokenID = claims.Jti
+	if c.PrintToken {
+		a.log.Printf("Granting token: %s\n", token)
+	}
+
+	resp := newTokenResponse(token, claims)
+	resp.Scope = strings.Join(scopes, " ")
+	resp.RefreshToken = refreshToken
+	return writeTokenResponse(w, resp)
+}
+
+// ProcessRevokeRequest revokes the refresh token given in the "token" form
+// value. Possession of the token is enough to revoke it.
+func (a *Authenticator) ProcessRevokeRequest(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return ErrMethodNotAllowed
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidRequest, err)
+	}
+
+	if err := a.RevokeRefreshToken(r.PostForm.Get("token")); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
@@ -0,0 +1,173 @@
+package dockerauth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postOAuthForm(t *testing.T, a *Authenticator, form url.Values) (*tokenResponse, error) {
+	r, _ := http.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = "127.0.0.1"
+	w := httptest.NewRecorder()
+
+	if err := a.ProcessOAuthRequest(w, r); err != nil {
+		return nil, err
+	}
+
+	resp := &tokenResponse{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), resp))
+	return resp, nil
+}
+
+func TestOAuthPasswordGrant(t *testing.T) {
+	a := newTestAuthenticator()
+
+	resp, err := postOAuthForm(t, a, url.Values{
+		"grant_type": {"password"},
+		"service":    {"localhost:5000"},
+		"client_id":  {"test-client"},
+		"username":   {"test"},
+		"password":   {"testing"},
+		"scope":      {"repository:alpine:pull repository:testing/app:push"},
+	})
+	ok(t, err)
+	equals(t, resp.RefreshToken, "")
+
+	payload := decodeTestToken(t, resp.AccessToken)
+	equals(t, payload.Access, []*AccessControl{
+		{Type: "repository", Name: "alpine", Actions: []string{"pull"}},
+		{Type: "repository", Name: "testing/app", Actions: []string{"push"}},
+	})
+
+	_, err = postOAuthForm(t, a, url.Values{
+		"grant_type": {"password"},
+		"service":    {"localhost:5000"},
+		"client_id":  {"test-client"},
+		"username":   {"test"},
+		"password":   {"wrong"},
+	})
+	equals(t, err, ErrInvalidLogin)
+
+	_, err = postOAuthForm(t, a, url.Values{
+		"grant_type": {"password"},
+		"service":    {"localhost:5000"},
+		"username":   {"test"},
+		"password":   {"testing"},
+	})
+	equals(t, err, ErrMissingClientID)
+}
+
+func TestOAuthRefreshTokenGrant(t *testing.T) {
+	a := newTestAuthenticator()
+
+	resp, err := postOAuthForm(t, a, url.Values{
+		"grant_type":  {"password"},
+		"service":     {"localhost:5000"},
+		"client_id":   {"test-client"},
+		"access_type": {"offline"},
+		"username":    {"test"},
+		"password":    {"testing"},
+	})
+	ok(t, err)
+	assert(t, resp.RefreshToken != "", "No refresh token issued")
+
+	refresh := url.Values{
+		"grant_type":    {"refresh_token"},
+		"service":       {"localhost:5000"},
+		"client_id":     {"test-client"},
+		"refresh_token": {resp.RefreshToken},
+		"scope":         {"repository:testing/app:push"},
+	}
+
+	resp2, err := postOAuthForm(t, a, refresh)
+	ok(t, err)
+	equals(t, resp2.RefreshToken, resp.RefreshToken)
+	equals(t, decodeTestToken(t, resp2.AccessToken).Access, []*AccessControl{
+		{Type: "repository", Name: "testing/app", Actions: []string{"push"}},
+	})
+
+	// Permissions are evaluated again on every exchange
+	store := a.accessControlStore.(*testUserStore)
+	store.acls["test"] = []*AccessControl{
+		{IP: "*", Name: "*", Actions: []string{"pull"}},
+	}
+	resp2, err = postOAuthForm(t, a, refresh)
+	ok(t, err)
+	equals(t, decodeTestToken(t, resp2.AccessToken).Access, []*AccessControl{
+		{Type: "repository", Name: "testing/app", Actions: []string{}},
+	})
+
+	// Access tokens can't be used as refresh tokens
+	refresh.Set("refresh_token", resp2.AccessToken)
+	_, err = postOAuthForm(t, a, refresh)
+	equals(t, err, ErrInvalidRefreshToken)
+
+	// Revoked tokens are rejected
+	ok(t, a.RevokeRefreshToken(resp.RefreshToken))
+	refresh.Set("refresh_token", resp.RefreshToken)
+	_, err = postOAuthForm(t, a, refresh)
+	equals(t, err, ErrInvalidRefreshToken)
+}
+
+func TestOAuthRefreshTokenTampered(t *testing.T) {
+	a := newTestAuthenticator()
+
+	token, err := a.GenerateRefreshToken("localhost:5000", "test", "test-client")
+	ok(t, err)
+
+	parts := strings.Split(token, ".")
+	forged := &refreshTokenPayload{Sub: "admin", Typ: refreshTokenType, Jti: "1"}
+	parts[1] = string(jsonEncodeJWTSection(forged))
+
+	_, err = a.validateRefreshToken(testRegistry(a), strings.Join(parts, "."))
+	equals(t, err, ErrInvalidRefreshToken)
+}
+
+func TestOAuthRefreshTokenExpiry(t *testing.T) {
+	a := newTestAuthenticator()
+	reg := testRegistry(a)
+
+	token, err := a.GenerateRefreshToken("localhost:5000", "test", "test-client")
+	ok(t, err)
+	payload, err := parseRefreshToken(reg.keys, token)
+	ok(t, err)
+	equals(t, payload.Exp-payload.Iat, int64(defaultRefreshTokenTTL.Seconds()))
+
+	equals(t, payload.Aud, "localhost:5000#refresh")
+
+	expired, err := encodeJWT(newJWTHeader(reg.keys.Active()), &refreshTokenPayload{
+		Iss: reg.Auth.Issuer, Aud: reg.Name + refreshTokenAudience, Sub: "test", Typ: refreshTokenType, Jti: "1",
+		Iat: time.Now().Add(-2 * time.Hour).Unix(), Exp: time.Now().Add(-time.Hour).Unix(),
+	}, reg.keys.Active())
+	ok(t, err)
+	_, err = a.validateRefreshToken(reg, expired)
+	equals(t, err, ErrInvalidRefreshToken)
+
+	// Tokens for the registry itself aren't refresh tokens
+	registryAud, err := encodeJWT(newJWTHeader(reg.keys.Active()), &refreshTokenPayload{
+		Iss: reg.Auth.Issuer, Aud: reg.Name, Sub: "test", Typ: refreshTokenType, Jti: "1",
+		Iat: time.Now().Unix(), Exp: time.Now().Add(time.Hour).Unix(),
+	}, reg.keys.Active())
+	ok(t, err)
+	_, err = a.validateRefreshToken(reg, registryAud)
+	equals(t, err, ErrInvalidRefreshToken)
+}
+
+func TestOAuthRefreshTokenDeletedUser(t *testing.T) {
+	a := newTestAuthenticator()
+
+	token, err := a.GenerateRefreshToken("localhost:5000", "test", "test-client")
+	ok(t, err)
+	_, err = a.validateRefreshToken(testRegistry(a), token)
+	ok(t, err)
+
+	delete(a.accessControlStore.(*testUserStore).users, "test")
+	_, err = a.validateRefreshToken(testRegistry(a), token)
+	equals(t, err, ErrInvalidRefreshToken)
+}
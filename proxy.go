@@ -0,0 +1,127 @@
+package dockerauth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+var ErrInvalidProxyHeader = errors.New("trustedProxyHeader must be Forwarded, X-Forwarded-For or X-Real-IP")
+
+// proxyHeaders are the headers a trusted proxy can pass the client's address
+// in. The first is used if none is configured.
+var proxyHeaders = []string{"X-Forwarded-For", "Forwarded", "X-Real-IP"}
+
+// parseTrustedProxies parses the configured proxy addresses. It returns nil
+// if no proxies are trusted.
+func parseTrustedProxies(proxies []string) (*ipList, error) {
+	if len(proxies) == 0 {
+		return nil, nil
+	}
+
+	l, err := parseIPList(strings.Join(proxies, ","))
+	if err != nil {
+		return nil, fmt.Errorf("trustedProxies: %w", err)
+	}
+	return l, nil
+}
+
+// parseProxyHeader returns the name of the configured proxy header as it's
+// spelled in proxyHeaders.
+func parseProxyHeader(name string) (string, error) {
+	if name == "" {
+		return proxyHeaders[0], nil
+	}
+	for _, header := range proxyHeaders {
+		if strings.EqualFold(name, header) {
+			return header, nil
+		}
+	}
+	return "", ErrInvalidProxyHeader
+}
+
+// clientIP returns the address of the client making request r without its
+// port. The configured proxy header is only used if the request comes from a
+// trusted proxy. Other proxy headers are passed through unchanged by most
+// proxies so they're always ignored.
+func (c *authConfig) clientIP(r *http.Request) string {
+	peer, err := parseHostIP(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	if !c.trustsProxy(peer) {
+		return peer.String()
+	}
+
+	switch c.proxyHeader {
+	case "Forwarded":
+		if hops := forwardedFor(r.Header.Values("Forwarded")); len(hops) > 0 {
+			return c.walkProxies(hops, peer).String()
+		}
+	case "X-Real-IP":
+		if realIP, err := parseHostIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return realIP.String()
+		}
+	default:
+		if hops := splitHeaderList(r.Header.Values("X-Forwarded-For")); len(hops) > 0 {
+			return c.walkProxies(hops, peer).String()
+		}
+	}
+	return peer.String()
+}
+
+func (c *authConfig) trustsProxy(ip netip.Addr) bool {
+	return c.trustedProxies != nil && c.trustedProxies.contains(ip)
+}
+
+// walkProxies follows a list of forwarded addresses from the proxy nearest to
+// the server back to the first address that isn't a trusted proxy, which is
+// the client. Addresses further left were supplied by the client and can't be
+// trusted. If an address can't be parsed the last proxy that could be is
+// used.
+func (c *authConfig) walkProxies(hops []string, peer netip.Addr) netip.Addr {
+	ip := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := parseHostIP(hops[i])
+		if err != nil {
+			return ip
+		}
+
+		ip = hop
+		if !c.trustsProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// forwardedFor returns the for parameters of RFC 7239 Forwarded headers in
+// order.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, element := range splitHeaderList(values) {
+		for _, pair := range strings.Split(element, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(strings.TrimSpace(key), "for") {
+				hops = append(hops, strings.Trim(strings.TrimSpace(value), `"`))
+			}
+		}
+	}
+	return hops
+}
+
+// splitHeaderList splits comma separated header values, which may be spread
+// over several headers, into their trimmed, non-empty elements.
+func splitHeaderList(values []string) []string {
+	var elements []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				elements = append(elements, element)
+			}
+		}
+	}
+	return elements
+}
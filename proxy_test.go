@@ -0,0 +1,100 @@
+package dockerauth
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+var clientIPTests = []struct {
+	header     string
+	remoteAddr string
+	headers    map[string]string
+	expected   string
+}{
+	// Headers from untrusted peers are ignored
+	{"X-Real-IP", "203.0.113.5:1234", map[string]string{"X-Real-IP": "10.0.0.1"}, "203.0.113.5"},
+	{"", "203.0.113.5:1234", map[string]string{"X-Forwarded-For": "10.0.0.1"}, "203.0.113.5"},
+	{"Forwarded", "203.0.113.5:1234", map[string]string{"Forwarded": "for=10.0.0.1"}, "203.0.113.5"},
+	{"", "[2001:db8::1]:1234", nil, "2001:db8::1"},
+
+	{"x-real-ip", "10.1.0.1:1234", map[string]string{"X-Real-IP": "198.51.100.7"}, "198.51.100.7"},
+	{"", "10.1.0.1:1234", nil, "10.1.0.1"},
+
+	// The first untrusted address from the right is the client, anything left
+	// of it could be spoofed
+	{"", "10.1.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.7, 10.1.0.2"}, "198.51.100.7"},
+	{"", "10.1.0.1:1234", map[string]string{"X-Forwarded-For": "10.1.0.3, 10.1.0.2"}, "10.1.0.3"},
+	{"", "10.1.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7, garbage"}, "10.1.0.1"},
+
+	{"Forwarded", "10.1.0.1:1234", map[string]string{"Forwarded": `for=1.2.3.4, for="[2001:db8::7]:4711";proto=https, for=10.1.0.2`}, "2001:db8::7"},
+	{"Forwarded", "10.1.0.1:1234", map[string]string{"Forwarded": "for=_hidden"}, "10.1.0.1"},
+
+	// Only the configured header is used, the others were sent by the client
+	{"X-Real-IP", "10.1.0.1:1234", map[string]string{
+		"Forwarded":       "for=10.0.0.8",
+		"X-Forwarded-For": "10.0.0.7",
+		"X-Real-IP":       "198.51.100.3",
+	}, "198.51.100.3"},
+	{"", "10.1.0.1:1234", map[string]string{
+		"Forwarded":       "for=10.0.0.8",
+		"X-Forwarded-For": "198.51.100.2",
+		"X-Real-IP":       "10.0.0.9",
+	}, "198.51.100.2"},
+	{"X-Forwarded-For", "10.1.0.1:1234", map[string]string{"Forwarded": "for=10.0.0.8"}, "10.1.0.1"},
+}
+
+func TestClientIP(t *testing.T) {
+	a := newTestAuthenticator()
+
+	for _, test := range clientIPTests {
+		config := newTestConfig()
+		config.TrustedProxies = []string{"10.1.0.0/16", "fd00::/8"}
+		config.TrustedProxyHeader = test.header
+		ok(t, a.SetConfig(config, nil))
+
+		r := httptest.NewRequest("GET", "/api/auth", nil)
+		r.RemoteAddr = test.remoteAddr
+		for key, value := range test.headers {
+			r.Header.Set(key, value)
+		}
+		equals(t, a.getConfig().clientIP(r), test.expected)
+	}
+
+	config := newTestConfig()
+	config.TrustedProxyHeader = "X-Client-IP"
+	equals(t, a.SetConfig(config, nil), ErrInvalidProxyHeader)
+}
+
+func TestTrustedProxiesACL(t *testing.T) {
+	a := newTestAuthenticator()
+	config := newTestConfig()
+	config.TrustedProxies = []string{"10.1.0.1"}
+	ok(t, a.SetConfig(config, nil))
+
+	store := a.accessControlStore.(*testUserStore)
+	store.acls["test"] = append(store.acls["test"],
+		&AccessControl{IP: "192.168.0.0/16", Name: "internal/*", Actions: []string{"pull"}})
+
+	event := &AuditEvent{}
+	for _, test := range []struct {
+		remoteAddr string
+		expected   []string
+	}{
+		{"10.1.0.1:1234", []string{"pull"}},
+		{"10.1.0.2:1234", []string{}},
+	} {
+		r := httptest.NewRequest("GET", "/api/auth?service=localhost:5000&scope=repository:internal/app:pull", nil)
+		r.RemoteAddr = test.remoteAddr
+		r.Header.Set("X-Forwarded-For", "192.168.1.10")
+
+		event = newAuditEvent(a.getConfig(), r, "localhost:5000", "test")
+		_, _, err := a.getToken(a.getConfig(), testRegistry(a), event, "test", "testing", r)
+		ok(t, err)
+		equals(t, event.Scopes[0].Granted, test.expected)
+	}
+	equals(t, event.ClientIP, "10.1.0.2")
+
+	config = newTestConfig()
+	config.TrustedProxies = []string{"10.1.0.0/16", "proxy.example.com"}
+	assert(t, a.SetConfig(config, nil) != nil, "Expected invalid trusted proxy error")
+}
@@ -0,0 +1,150 @@
+package dockerauth
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMissingRegistry   = errors.New("configuration has no [[registry]] section")
+	ErrDuplicateRegistry = errors.New("registry is configured more than once")
+)
+
+// Reloader is implemented by stores which can reload their data, such as the
+// accounts file of a FileAuthenticator.
+type Reloader interface {
+	Reload() error
+}
+
+// ReloadConfig loads the configuration at path and its signing keys and
+// replaces the authenticator's configuration with them. If anything fails to
+// load the current configuration is kept. Backend sections are only read at
+// startup.
+func (a *Authenticator) ReloadConfig(path string) error {
+	c, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	return a.SetConfig(c, nil)
+}
+
+// SetConfig replaces the authenticator's configuration and signing keys. Keys
+// are given by registry name, the configured keys are loaded for registries
+// missing from keys. Requests already in progress finish with the previous
+// configuration.
+func (a *Authenticator) SetConfig(c *Config, keys map[string]*KeySet) error {
+	if err := validateConfig(c); err != nil {
+		return err
+	}
+
+	trustedProxies, err := parseTrustedProxies(c.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	proxyHeader, err := parseProxyHeader(c.TrustedProxyHeader)
+	if err != nil {
+		return err
+	}
+
+	ac := &authConfig{
+		Config:         c,
+		registries:     make([]*registry, len(c.Registry)),
+		trustedProxies: trustedProxies,
+		proxyHeader:    proxyHeader,
+	}
+	for i, r := range c.Registry {
+		ks := keys[r.Name]
+		if ks == nil {
+			var err error
+			ks, err = LoadRegistryKeys(r)
+			if err != nil {
+				return fmt.Errorf("registry %q: %w", r.Name, err)
+			}
+		}
+		ac.registries[i] = &registry{RegistryConfig: r, keys: ks, metrics: a.metrics}
+	}
+
+	a.config.Store(ac)
+	return nil
+}
+
+func validateConfig(c *Config) error {
+	if c == nil || len(c.Registry) == 0 {
+		return ErrMissingRegistry
+	}
+
+	for i, r := range c.Registry {
+		if c.Registry.Get(r.Name) != c.Registry[i] {
+			return fmt.Errorf("%w: %q", ErrDuplicateRegistry, r.Name)
+		}
+		if err := validateACLs(r.Anonymous.Permissions); err != nil {
+			return fmt.Errorf("registry %q anonymous: %w", r.Name, err)
+		}
+	}
+
+	for _, g := range c.Group {
+		if err := validateACLs(g.Permissions); err != nil {
+			return fmt.Errorf("group %q: %w", g.Name, err)
+		}
+	}
+
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		return err
+	}
+	_, err := parseProxyHeader(c.TrustedProxyHeader)
+	return err
+}
+
+// WatchFiles calls onChange whenever the modification time or size of any of
+// paths changes, checking every interval. Files which can't be read are
+// ignored until they can. The returned function stops watching.
+func WatchFiles(interval time.Duration, paths []string, onChange func()) (stop func()) {
+	type fileState struct {
+		modTime time.Time
+		size    int64
+	}
+
+	statFiles := func() map[string]fileState {
+		states := make(map[string]fileState, len(paths))
+		for _, path := range paths {
+			if info, err := os.Stat(path); err == nil {
+				states[path] = fileState{info.ModTime(), info.Size()}
+			}
+		}
+		return states
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last := statFiles()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			current := statFiles()
+			changed := false
+			for _, path := range paths {
+				if state, ok := current[path]; ok && state != last[path] {
+					changed = true
+				}
+			}
+			last = current
+
+			if changed {
+				onChange()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
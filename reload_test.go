@@ -0,0 +1,176 @@
+package dockerauth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, path, name string) {
+	buf, err := os.ReadFile("testdata/config.toml")
+	ok(t, err)
+	c := strings.Replace(string(buf), `name = "localhost:5000"`, `name = "`+name+`"`, 1)
+	ok(t, os.WriteFile(path, []byte(c), 0600))
+}
+
+func TestReloadConfig(t *testing.T) {
+	a := newTestAuthenticator()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	writeTestConfig(t, path, "localhost:5000")
+	ok(t, a.ReloadConfig(path))
+	keys := testRegistry(a).keys
+
+	// Broken files keep the current configuration
+	ok(t, os.WriteFile(path, []byte("[registry"), 0600))
+	assert(t, a.ReloadConfig(path) != nil, "Expected parse error")
+
+	ok(t, os.WriteFile(path, []byte("backend = \"file\"\n"), 0600))
+	equals(t, a.ReloadConfig(path), ErrMissingRegistry)
+
+	writeTestConfig(t, path, "staging:5000")
+	buf, err := os.ReadFile(path)
+	ok(t, err)
+	ok(t, os.WriteFile(path, []byte(strings.Replace(string(buf), "testdata/auth.key", "testdata/missing.key", 1)), 0600))
+	assert(t, a.ReloadConfig(path) != nil, "Expected missing key error")
+
+	equals(t, a.getConfig().Registry[0].Name, "localhost:5000")
+	assert(t, testRegistry(a).keys == keys, "Signing keys were replaced")
+
+	writeTestConfig(t, path, "staging:5000")
+	ok(t, a.ReloadConfig(path))
+	equals(t, a.getConfig().Registry[0].Name, "staging:5000")
+	assert(t, testRegistry(a).keys != keys, "Signing keys weren't reloaded")
+}
+
+func TestLoadConfigRegistries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+
+	ok(t, os.WriteFile(path, []byte("[[registry]]\nname = \"a\"\n[registry.auth]\nissuer = \"a\"\n[[registry]]\nname = \"b\"\n"), 0600))
+	c, err := LoadConfig(path)
+	ok(t, err)
+	equals(t, len(c.Registry), 2)
+	equals(t, c.Registry.Get("a").Auth.Issuer, "a")
+	assert(t, c.Registry.Get("b") != nil, "Registry b is missing")
+	assert(t, c.Registry.Get("c") == nil, "Unexpected registry c")
+
+	// A single registry table
+	ok(t, os.WriteFile(path, []byte("[registry]\nname = \"a\"\n"), 0600))
+	c, err = LoadConfig(path)
+	ok(t, err)
+	equals(t, len(c.Registry), 1)
+	equals(t, c.Registry[0].Name, "a")
+
+	ok(t, os.WriteFile(path, []byte("[[registry]]\nname = \"a\"\n[[registry]]\nname = \"a\"\n"), 0600))
+	_, err = LoadConfig(path)
+	assert(t, errors.Is(err, ErrDuplicateRegistry), "Expected duplicate registry error, got %v", err)
+}
+
+func TestLoadConfigInvalidIP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+
+	ok(t, os.WriteFile(path, []byte("[[registry]]\nname = \"a\"\n"+
+		"[[group]]\nname = \"dev\"\n[[group.permissions]]\nip = \"10.0.0.0/33\"\nname = \"dev/**\"\nactions = [\"pull\"]\n"), 0600))
+	_, err := LoadConfig(path)
+	assert(t, errors.Is(err, ErrInvalidIPList), "Expected invalid IP error, got %v", err)
+	equals(t, err.Error(), `group "dev": permission for "dev/**": invalid IP address or CIDR "10.0.0.0/33"`)
+
+	ok(t, os.WriteFile(path, []byte("[[user]]\nusername = \"test\"\n[[user.permissions]]\nip = \"10.0.0.1, nope\"\nname = \"**\"\nactions = [\"pull\"]\n"), 0600))
+	_, err = NewFileAuthenticator(path)
+	assert(t, errors.Is(err, ErrInvalidIPList), "Expected invalid IP error, got %v", err)
+}
+
+func TestReloadDuringRequests(t *testing.T) {
+	a := newTestAuthenticator()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	writeTestConfig(t, path, "localhost:5000")
+	ok(t, a.ReloadConfig(path))
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				req := httptest.NewRequest("GET", "/api/auth?service=localhost:5000&scope=repository:testing/app:pull", nil)
+				_, err := a.GetToken("test", "testing", req)
+				if err != nil && !errors.Is(err, ErrUnknownService) {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		name := "localhost:5000"
+		if i%2 == 0 {
+			name = "staging:5000"
+		}
+		writeTestConfig(t, path, name)
+		ok(t, a.ReloadConfig(path))
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestFileAuthenticatorReload(t *testing.T) {
+	buf, err := os.ReadFile("testdata/accounts.toml")
+	ok(t, err)
+	path := filepath.Join(t.TempDir(), "accounts.toml")
+	ok(t, os.WriteFile(path, buf, 0600))
+
+	fa, err := NewFileAuthenticator(path)
+	ok(t, err)
+
+	ok(t, os.WriteFile(path, []byte("[[user]\n"), 0600))
+	assert(t, fa.Reload() != nil, "Expected parse error")
+	login, err := fa.Login("test", "testing")
+	ok(t, err)
+	assert(t, login, "Users were lost after a failed reload")
+
+	ok(t, os.WriteFile(path, []byte(strings.Replace(string(buf), `username = "test"`, `username = "renamed"`, 1)), 0600))
+	ok(t, fa.Reload())
+	login, err = fa.Login("renamed", "testing")
+	ok(t, err)
+	assert(t, login, "Reloaded user can't login")
+	login, err = fa.Login("test", "testing")
+	ok(t, err)
+	assert(t, !login, "Removed user can still login")
+}
+
+func TestWatchFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	ok(t, os.WriteFile(path, []byte("a"), 0600))
+
+	changes := make(chan struct{}, 10)
+	stop := WatchFiles(10*time.Millisecond, []string{path, filepath.Join(t.TempDir(), "missing")}, func() {
+		changes <- struct{}{}
+	})
+	defer stop()
+
+	time.Sleep(30 * time.Millisecond)
+	select {
+	case <-changes:
+		t.Fatal("Change reported for unchanged files")
+	default:
+	}
+
+	ok(t, os.WriteFile(path, []byte("ab"), 0600))
+	select {
+	case <-changes:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Change wasn't reported")
+	}
+}
@@ -5,15 +5,10 @@ import "testing"
 const privKeyID = "W72W:52MO:BCLR:UKQI:I6AY:WYSP:YYVA:HXLY:RJ5P:462D:AI4Q:JQFB"
 
 func TestRSAFingerprint(t *testing.T) {
-	config = &Config{
-		Registry: &RegistryConfig{},
-	}
-	config.Registry.Auth.Key = "testdata/auth.key"
-
-	key, err := getPrivateKey()
+	keys, err := LoadRegistryKeys(newTestConfig().Registry[0])
 	ok(t, err)
 
-	id := getRSAKeyID(key)
+	id := keys.Active().KeyID()
 	if id != privKeyID {
 		t.Errorf("Incorrect key ID. Expected %s, got %s", privKeyID, id)
 	}
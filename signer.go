@@ -0,0 +1,236 @@
+package dockerauth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"strings"
+)
+
+var (
+	ErrKeyMustBePEMEncoded = errors.New("invalid key: Key must be PEM encoded PKCS1, PKCS8 or SEC1 private key")
+	ErrUnsupportedKeyType  = errors.New("key is not a valid RSA, ECDSA or Ed25519 private key")
+	ErrUnsupportedCurve    = errors.New("ECDSA key must use the P-256, P-384 or P-521 curve")
+	ErrInvalidSignature    = errors.New("invalid signature")
+)
+
+// Signer signs tokens with a private key. The JWT algorithm is determined by
+// the type of key.
+type Signer interface {
+	// Alg returns the JWT "alg" header value.
+	Alg() string
+	// KeyID returns the libtrust style fingerprint of the public key.
+	KeyID() string
+	PublicKey() crypto.PublicKey
+	Sign(message []byte) ([]byte, error)
+	Verify(message, signature []byte) error
+}
+
+// LoadSigner reads a PEM encoded RSA, ECDSA or Ed25519 private key from path.
+func LoadSigner(path string) (Signer, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parsePrivateKeyFromPEM(bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSigner(key)
+}
+
+// NewSigner returns a Signer for an *rsa.PrivateKey, *ecdsa.PrivateKey or
+// ed25519.PrivateKey.
+func NewSigner(key crypto.PrivateKey) (Signer, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		kid, err := getKeyID(k.Public())
+		if err != nil {
+			return nil, err
+		}
+		return &rsaSigner{key: k, kid: kid}, nil
+
+	case *ecdsa.PrivateKey:
+		s := &ecdsaSigner{key: k}
+		switch k.Curve {
+		case elliptic.P256():
+			s.alg, s.hash = "ES256", crypto.SHA256
+		case elliptic.P384():
+			s.alg, s.hash = "ES384", crypto.SHA384
+		case elliptic.P521():
+			s.alg, s.hash = "ES512", crypto.SHA512
+		default:
+			return nil, ErrUnsupportedCurve
+		}
+
+		kid, err := getKeyID(k.Public())
+		if err != nil {
+			return nil, err
+		}
+		s.kid = kid
+		return s, nil
+
+	case ed25519.PrivateKey:
+		kid, err := getKeyID(k.Public())
+		if err != nil {
+			return nil, err
+		}
+		return &ed25519Signer{key: k, kid: kid}, nil
+
+	case *ed25519.PrivateKey:
+		return NewSigner(*k)
+	}
+
+	return nil, ErrUnsupportedKeyType
+}
+
+// parsePrivateKeyFromPEM parses a PEM encoded PKCS1, PKCS8 or SEC1 private key.
+func parsePrivateKeyFromPEM(key []byte) (crypto.PrivateKey, error) {
+	var err error
+
+	// Parse PEM block
+	var block *pem.Block
+	if block, _ = pem.Decode(key); block == nil {
+		return nil, ErrKeyMustBePEMEncoded
+	}
+
+	var parsedKey interface{}
+	if parsedKey, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		if parsedKey, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+			if parsedKey, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+				return nil, ErrUnsupportedKeyType
+			}
+		}
+	}
+
+	return parsedKey, nil
+}
+
+// getKeyID computes the libtrust key ID of a public key. This is the format
+// the registry expects in the "kid" header.
+func getKeyID(pub crypto.PublicKey) (string, error) {
+	derBytes, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	hasher := crypto.SHA256.New()
+	hasher.Write(derBytes)
+
+	s := strings.TrimRight(base32.StdEncoding.EncodeToString(hasher.Sum(nil)[:30]), "=")
+	var buf bytes.Buffer
+	var i int
+	for i = 0; i < len(s)/4-1; i++ {
+		start := i * 4
+		end := start + 4
+		buf.WriteString(s[start:end] + ":")
+	}
+	buf.WriteString(s[i*4:])
+	return buf.String(), nil
+}
+
+type rsaSigner struct {
+	key *rsa.PrivateKey
+	kid string
+}
+
+func (s *rsaSigner) Alg() string                 { return "RS256" }
+func (s *rsaSigner) KeyID() string               { return s.kid }
+func (s *rsaSigner) PublicKey() crypto.PublicKey { return s.key.Public() }
+
+func (s *rsaSigner) Sign(message []byte) ([]byte, error) {
+	hasher := crypto.SHA256.New()
+	hasher.Write(message)
+	return rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hasher.Sum(nil))
+}
+
+func (s *rsaSigner) Verify(message, signature []byte) error {
+	hasher := crypto.SHA256.New()
+	hasher.Write(message)
+	return rsa.VerifyPKCS1v15(&s.key.PublicKey, crypto.SHA256, hasher.Sum(nil), signature)
+}
+
+type ecdsaSigner struct {
+	key  *ecdsa.PrivateKey
+	kid  string
+	alg  string
+	hash crypto.Hash
+}
+
+func (s *ecdsaSigner) Alg() string                 { return s.alg }
+func (s *ecdsaSigner) KeyID() string               { return s.kid }
+func (s *ecdsaSigner) PublicKey() crypto.PublicKey { return s.key.Public() }
+
+// keySize is the length in bytes of each of the R and S values in a JWS
+// ECDSA signature.
+func (s *ecdsaSigner) keySize() int {
+	return (s.key.Curve.Params().BitSize + 7) / 8
+}
+
+// Sign returns the signature as the concatenation of R and S as required by
+// JWS rather than the ASN.1 encoding used by crypto/ecdsa.
+func (s *ecdsaSigner) Sign(message []byte) ([]byte, error) {
+	hasher := s.hash.New()
+	hasher.Write(message)
+
+	r, ss, err := ecdsa.Sign(rand.Reader, s.key, hasher.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	size := s.keySize()
+	sig := make([]byte, 2*size)
+	r.FillBytes(sig[:size])
+	ss.FillBytes(sig[size:])
+	return sig, nil
+}
+
+func (s *ecdsaSigner) Verify(message, signature []byte) error {
+	size := s.keySize()
+	if len(signature) != 2*size {
+		return ErrInvalidSignature
+	}
+
+	hasher := s.hash.New()
+	hasher.Write(message)
+
+	r := new(big.Int).SetBytes(signature[:size])
+	ss := new(big.Int).SetBytes(signature[size:])
+	if !ecdsa.Verify(&s.key.PublicKey, hasher.Sum(nil), r, ss) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// ed25519Signer signs EdDSA tokens. The distribution registry can't verify
+// these, they're for services reading keys from the JWKS endpoint.
+type ed25519Signer struct {
+	key ed25519.PrivateKey
+	kid string
+}
+
+func (s *ed25519Signer) Alg() string                 { return "EdDSA" }
+func (s *ed25519Signer) KeyID() string               { return s.kid }
+func (s *ed25519Signer) PublicKey() crypto.PublicKey { return s.key.Public() }
+
+func (s *ed25519Signer) Sign(message []byte) ([]byte, error) {
+	return ed25519.Sign(s.key, message), nil
+}
+
+func (s *ed25519Signer) Verify(message, signature []byte) error {
+	if !ed25519.Verify(s.key.Public().(ed25519.PublicKey), message, signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package dockerauth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/libtrust"
+)
+
+// writeTestKey writes key as a PKCS8 PEM file and returns its path.
+func writeTestKey(t *testing.T, key crypto.PrivateKey) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	ok(t, err)
+
+	path := filepath.Join(t.TempDir(), "auth.key")
+	ok(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+	return path
+}
+
+var signerTests = []struct {
+	alg    string
+	newKey func() (crypto.PrivateKey, error)
+}{
+	{
+		alg: "ES256",
+		newKey: func() (crypto.PrivateKey, error) {
+			return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		},
+	},
+	{
+		alg: "ES384",
+		newKey: func() (crypto.PrivateKey, error) {
+			return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		},
+	},
+	{
+		alg: "ES512",
+		newKey: func() (crypto.PrivateKey, error) {
+			return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+		},
+	},
+	{
+		alg: "EdDSA",
+		newKey: func() (crypto.PrivateKey, error) {
+			_, key, err := ed25519.GenerateKey(rand.Reader)
+			return key, err
+		},
+	},
+}
+
+func TestSignerTokens(t *testing.T) {
+	for _, test := range signerTests {
+		key, err := test.newKey()
+		ok(t, err)
+
+		config := newTestConfig()
+		config.Registry[0].Auth.Key = writeTestKey(t, key)
+
+		keys, err := LoadRegistryKeys(config.Registry[0])
+		ok(t, err)
+		signer := keys.Active()
+		equals(t, signer.Alg(), test.alg)
+
+		token, _, err := generateToken(&registry{RegistryConfig: config.Registry[0], keys: keys}, "test", nil, 0)
+		ok(t, err)
+
+		parts := strings.Split(token, ".")
+		header := &jwtHeader{}
+		ok(t, jsonDecodeJWTSection([]byte(parts[0]), header))
+		equals(t, header.Alg, test.alg)
+		equals(t, header.Kid, signer.KeyID())
+
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		ok(t, err)
+		ok(t, signer.Verify([]byte(parts[0]+"."+parts[1]), signature))
+
+		payload := &jwtPayload{}
+		ok(t, decodeJWT(token, payload, keys))
+		equals(t, payload.Sub, "test")
+	}
+}
+
+// The registry looks up the verification key by the libtrust key ID and
+// verifies the signature with libtrust.
+func TestSignerLibtrustCompatible(t *testing.T) {
+	signers := []Signer{}
+
+	rsaSigner, err := LoadSigner("testdata/auth.key")
+	ok(t, err)
+	signers = append(signers, rsaSigner)
+
+	for _, test := range signerTests {
+		if test.alg == "EdDSA" {
+			continue // Not supported by libtrust
+		}
+		key, err := test.newKey()
+		ok(t, err)
+		signer, err := NewSigner(key)
+		ok(t, err)
+		signers = append(signers, signer)
+	}
+
+	for _, signer := range signers {
+		pub, err := libtrust.FromCryptoPublicKey(signer.PublicKey())
+		ok(t, err)
+		equals(t, signer.KeyID(), pub.KeyID())
+
+		message := []byte("header.payload")
+		signature, err := signer.Sign(message)
+		ok(t, err)
+		ok(t, pub.Verify(bytes.NewReader(message), signer.Alg(), signature))
+	}
+}
+
+func TestSignerEd25519KeyID(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	ok(t, err)
+
+	signer, err := NewSigner(key)
+	ok(t, err)
+
+	kid, err := getKeyID(key.Public())
+	ok(t, err)
+	equals(t, signer.KeyID(), kid)
+	assert(t, len(kid) == len(privKeyID), "Incorrect key ID format: %s", kid)
+}
+
+func TestSignerUnsupportedKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	ok(t, err)
+
+	_, err = NewSigner(key)
+	equals(t, err, ErrUnsupportedCurve)
+
+	_, err = NewSigner("not a key")
+	equals(t, err, ErrUnsupportedKeyType)
+}
@@ -0,0 +1,493 @@
+package dockerauth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	passlib "gopkg.in/hlandau/passlib.v1"
+)
+
+var (
+	ErrSQLUnknownDriver  = errors.New("SQL driver must be sqlite3 or postgres")
+	ErrSQLSchemaOutdated = errors.New("SQL schema is outdated, run the migrate command")
+)
+
+// SQLConfig configures an SQLAuthenticator. The driver must be registered by
+// importing it, cmd/docker-auth registers sqlite3 and postgres.
+type SQLConfig struct {
+	Driver string
+	DSN    string
+}
+
+type sqlDialect int
+
+const (
+	sqlDialectSQLite sqlDialect = iota
+	sqlDialectPostgres
+)
+
+// sqlMigrations are the statements bringing the schema to each version, the
+// first entry creates version 1. Entries must never be changed once released,
+// schema changes are made by appending a new entry.
+//
+// Schema:
+//
+//	users          username, password (passlib hash)
+//	group_members  group_name, username
+//	permissions    id, username or group_name, type, ip, repository, actions,
+//	               service (version 2)
+//
+// Permission actions are comma separated. Each permission belongs to either a
+// user or a group, group permissions apply to every member. Permissions with
+// an empty service apply to every registry.
+var sqlMigrations = map[sqlDialect][][]string{
+	sqlDialectSQLite: {
+		{
+			`CREATE TABLE users (
+				username TEXT PRIMARY KEY,
+				password TEXT NOT NULL
+			)`,
+			`CREATE TABLE group_members (
+				group_name TEXT NOT NULL,
+				username TEXT NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+				PRIMARY KEY (group_name, username)
+			)`,
+			`CREATE INDEX group_members_username ON group_members (username)`,
+			`CREATE TABLE permissions (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				username TEXT REFERENCES users (username) ON DELETE CASCADE,
+				group_name TEXT,
+				type TEXT NOT NULL DEFAULT '',
+				ip TEXT NOT NULL DEFAULT '*',
+				repository TEXT NOT NULL,
+				actions TEXT NOT NULL,
+				CHECK ((username IS NULL) <> (group_name IS NULL))
+			)`,
+			`CREATE INDEX permissions_username ON permissions (username)`,
+			`CREATE INDEX permissions_group_name ON permissions (group_name)`,
+		},
+		{
+			`ALTER TABLE permissions ADD COLUMN service TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	sqlDialectPostgres: {
+		{
+			`CREATE TABLE users (
+				username TEXT PRIMARY KEY,
+				password TEXT NOT NULL
+			)`,
+			`CREATE TABLE group_members (
+				group_name TEXT NOT NULL,
+				username TEXT NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+				PRIMARY KEY (group_name, username)
+			)`,
+			`CREATE INDEX group_members_username ON group_members (username)`,
+			`CREATE TABLE permissions (
+				id BIGSERIAL PRIMARY KEY,
+				username TEXT REFERENCES users (username) ON DELETE CASCADE,
+				group_name TEXT,
+				type TEXT NOT NULL DEFAULT '',
+				ip TEXT NOT NULL DEFAULT '*',
+				repository TEXT NOT NULL,
+				actions TEXT NOT NULL,
+				CHECK ((username IS NULL) <> (group_name IS NULL))
+			)`,
+			`CREATE INDEX permissions_username ON permissions (username)`,
+			`CREATE INDEX permissions_group_name ON permissions (group_name)`,
+		},
+		{
+			`ALTER TABLE permissions ADD COLUMN service TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+}
+
+// SQLAuthenticator is a UserAuthenticator, AccessControlStore, GroupProvider
+// and UserStore backed by an SQLite or PostgreSQL database.
+type SQLAuthenticator struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+// NewSQLAuthenticator opens the database in c. The schema must be up to date,
+// see MigrateSQL.
+func NewSQLAuthenticator(c *SQLConfig) (*SQLAuthenticator, error) {
+	a, err := openSQL(c)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := a.schemaVersion()
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+	if version < len(sqlMigrations[a.dialect]) {
+		a.Close()
+		return nil, ErrSQLSchemaOutdated
+	}
+	return a, nil
+}
+
+// MigrateSQL creates or updates the schema of the database in c. It returns
+// the schema version before and after migrating.
+func MigrateSQL(c *SQLConfig) (int, int, error) {
+	a, err := openSQL(c)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer a.Close()
+
+	from, err := a.schemaVersion()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	migrations := sqlMigrations[a.dialect]
+	for version := from + 1; version <= len(migrations); version++ {
+		if err := a.migrate(version, migrations[version-1]); err != nil {
+			return from, version - 1, fmt.Errorf("migration %d: %s", version, err)
+		}
+	}
+	return from, len(migrations), nil
+}
+
+func openSQL(c *SQLConfig) (*SQLAuthenticator, error) {
+	var dialect sqlDialect
+	switch c.Driver {
+	case "sqlite3":
+		dialect = sqlDialectSQLite
+	case "postgres":
+		dialect = sqlDialectPostgres
+	default:
+		return nil, ErrSQLUnknownDriver
+	}
+
+	db, err := sql.Open(c.Driver, c.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLAuthenticator{db: db, dialect: dialect}, nil
+}
+
+func (a *SQLAuthenticator) Close() error {
+	return a.db.Close()
+}
+
+// schemaVersion returns the last applied migration, creating the version
+// table if needed.
+func (a *SQLAuthenticator) schemaVersion() (int, error) {
+	if _, err := a.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL)`); err != nil {
+		return 0, err
+	}
+
+	var version int
+	err := a.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+func (a *SQLAuthenticator) migrate(version int, statements []string) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(a.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), version); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// rebind replaces ? placeholders with the dialect's placeholders.
+func (a *SQLAuthenticator) rebind(query string) string {
+	if a.dialect != sqlDialectPostgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (a *SQLAuthenticator) Login(username, password string) (bool, error) {
+	var hash string
+	err := a.db.QueryRow(a.rebind(`SELECT password FROM users WHERE username = ?`), username).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return passlib.VerifyNoUpgrade(password, hash) == nil, nil
+}
+
+// GetACLS returns the permissions of username and of the groups they're a
+// member of in the database.
+func (a *SQLAuthenticator) GetACLS(username string) ([]*AccessControl, error) {
+	rows, err := a.db.Query(a.rebind(`
+		SELECT type, ip, repository, actions, service FROM permissions
+		WHERE username = ?
+		OR group_name IN (SELECT group_name FROM group_members WHERE username = ?)
+		ORDER BY id`), username, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var acls []*AccessControl
+	for rows.Next() {
+		acl, err := scanSQLPermission(rows)
+		if err != nil {
+			return nil, err
+		}
+		acls = append(acls, acl)
+	}
+	return acls, rows.Err()
+}
+
+func (a *SQLAuthenticator) GetGroups(username string) ([]string, error) {
+	rows, err := a.db.Query(a.rebind(`SELECT group_name FROM group_members WHERE username = ? ORDER BY group_name`), username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []string
+	for rows.Next() {
+		var group string
+		if err := rows.Scan(&group); err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, rows.Err()
+}
+
+// ListUsers returns all users with their own permissions, group permissions
+// aren't included.
+func (a *SQLAuthenticator) ListUsers() ([]*UserConfig, error) {
+	var users []*UserConfig
+	byName := make(map[string]*UserConfig)
+
+	rows, err := a.db.Query(`SELECT username, password FROM users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		u := &UserConfig{}
+		if err := rows.Scan(&u.Username, &u.Password); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		users = append(users, u)
+		byName[u.Username] = u
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = a.db.Query(`SELECT username, group_name FROM group_members ORDER BY group_name`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var username, group string
+		if err := rows.Scan(&username, &group); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if u, exists := byName[username]; exists {
+			u.Groups = append(u.Groups, group)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = a.db.Query(`SELECT username, type, ip, repository, actions, service FROM permissions WHERE username IS NOT NULL ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var username string
+		acl, err := scanSQLPermission(rows, &username)
+		if err != nil {
+			return nil, err
+		}
+		if u, exists := byName[username]; exists {
+			u.Permissions = append(u.Permissions, acl)
+		}
+	}
+	return users, rows.Err()
+}
+
+// GetUser returns username with their own permissions, group permissions
+// aren't included.
+func (a *SQLAuthenticator) GetUser(username string) (*UserConfig, error) {
+	u := &UserConfig{Username: username}
+	err := a.db.QueryRow(a.rebind(`SELECT password FROM users WHERE username = ?`), username).Scan(&u.Password)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Groups, err = a.GetGroups(username); err != nil {
+		return nil, err
+	}
+
+	rows, err := a.db.Query(a.rebind(`SELECT type, ip, repository, actions, service FROM permissions WHERE username = ? ORDER BY id`), username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		acl, err := scanSQLPermission(rows)
+		if err != nil {
+			return nil, err
+		}
+		u.Permissions = append(u.Permissions, acl)
+	}
+	return u, rows.Err()
+}
+
+func (a *SQLAuthenticator) CreateUser(user *UserConfig) error {
+	return a.inTx(func(tx *sql.Tx) error {
+		var exists int
+		err := tx.QueryRow(a.rebind(`SELECT COUNT(*) FROM users WHERE username = ?`), user.Username).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists > 0 {
+			return ErrUserExists
+		}
+
+		if _, err := tx.Exec(a.rebind(`INSERT INTO users (username, password) VALUES (?, ?)`), user.Username, user.Password); err != nil {
+			return err
+		}
+		return a.insertUserRelations(tx, user)
+	})
+}
+
+// UpdateUser replaces the password, groups and permissions of user.
+func (a *SQLAuthenticator) UpdateUser(user *UserConfig) error {
+	return a.inTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(a.rebind(`UPDATE users SET password = ? WHERE username = ?`), user.Password, user.Username)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrUserNotFound
+		}
+
+		if err := a.deleteUserRelations(tx, user.Username); err != nil {
+			return err
+		}
+		return a.insertUserRelations(tx, user)
+	})
+}
+
+func (a *SQLAuthenticator) DeleteUser(username string) error {
+	return a.inTx(func(tx *sql.Tx) error {
+		// SQLite only cascades deletes when foreign keys are enabled
+		if err := a.deleteUserRelations(tx, username); err != nil {
+			return err
+		}
+
+		res, err := tx.Exec(a.rebind(`DELETE FROM users WHERE username = ?`), username)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrUserNotFound
+		}
+		return nil
+	})
+}
+
+func (a *SQLAuthenticator) deleteUserRelations(tx *sql.Tx, username string) error {
+	if _, err := tx.Exec(a.rebind(`DELETE FROM group_members WHERE username = ?`), username); err != nil {
+		return err
+	}
+	_, err := tx.Exec(a.rebind(`DELETE FROM permissions WHERE username = ?`), username)
+	return err
+}
+
+func (a *SQLAuthenticator) insertUserRelations(tx *sql.Tx, user *UserConfig) error {
+	for _, group := range user.Groups {
+		if _, err := tx.Exec(a.rebind(`INSERT INTO group_members (group_name, username) VALUES (?, ?)`), group, user.Username); err != nil {
+			return err
+		}
+	}
+
+	for _, acl := range user.Permissions {
+		_, err := tx.Exec(a.rebind(`INSERT INTO permissions (username, type, ip, repository, actions, service) VALUES (?, ?, ?, ?, ?, ?)`),
+			user.Username, acl.Type, acl.IP, acl.Name, strings.Join(acl.Actions, ","), acl.Service)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *SQLAuthenticator) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// scanSQLPermission scans a row of type, ip, repository, actions and service
+// columns preceded by dest. Rows with an invalid ip aren't an error so one bad
+// row doesn't lock the user out of the admin API, which can replace it. They
+// deny access to the repositories they match and are logged when that
+// happens.
+func scanSQLPermission(rows *sql.Rows, dest ...interface{}) (*AccessControl, error) {
+	acl := &AccessControl{}
+	var actions string
+	if err := rows.Scan(append(dest, &acl.Type, &acl.IP, &acl.Name, &actions, &acl.Service)...); err != nil {
+		return nil, err
+	}
+	for _, action := range strings.Split(actions, ",") {
+		acl.Actions = append(acl.Actions, strings.TrimSpace(action))
+	}
+	return acl, nil
+}
@@ -0,0 +1,170 @@
+package dockerauth
+
+import (
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestSQLAuthenticator(t *testing.T) *SQLAuthenticator {
+	c := &SQLConfig{
+		Driver: "sqlite3",
+		DSN:    filepath.Join(t.TempDir(), "auth.db"),
+	}
+
+	_, err := NewSQLAuthenticator(c)
+	equals(t, err, ErrSQLSchemaOutdated)
+
+	from, to, err := MigrateSQL(c)
+	ok(t, err)
+	equals(t, from, 0)
+	equals(t, to, len(sqlMigrations[sqlDialectSQLite]))
+
+	// Migrating again is a no-op
+	from, to, err = MigrateSQL(c)
+	ok(t, err)
+	equals(t, from, to)
+
+	a, err := NewSQLAuthenticator(c)
+	ok(t, err)
+	t.Cleanup(func() { a.Close() })
+
+	stmts := []string{
+		// password = testing
+		`INSERT INTO users (username, password) VALUES ('test', '$6$rQg0hrgd$Ve2HTH6dPcKaZM8cZXX99W0oo.XHFEyzBG6WGH7.bs3J1MLMe5ZDgBcu3bB2P5J4O9xgIHpi0XAKKIWM4nKdg/')`,
+		`INSERT INTO users (username, password) VALUES ('robot', '$6$rQg0hrgd$Ve2HTH6dPcKaZM8cZXX99W0oo.XHFEyzBG6WGH7.bs3J1MLMe5ZDgBcu3bB2P5J4O9xgIHpi0XAKKIWM4nKdg/')`,
+		`INSERT INTO group_members (group_name, username) VALUES ('developers', 'test')`,
+		`INSERT INTO group_members (group_name, username) VALUES ('ci', 'test')`,
+		`INSERT INTO permissions (username, repository, actions) VALUES ('test', 'testing/*', 'push, pull')`,
+		`INSERT INTO permissions (group_name, repository, actions) VALUES ('developers', 'dev/**', 'pull')`,
+		`INSERT INTO permissions (group_name, type, repository, actions) VALUES ('ci', 'registry', 'catalog', '*')`,
+		`INSERT INTO permissions (group_name, repository, actions) VALUES ('ops', '**', '*')`,
+	}
+	for _, stmt := range stmts {
+		_, err := a.db.Exec(stmt)
+		ok(t, err)
+	}
+	return a
+}
+
+func TestSQLLogin(t *testing.T) {
+	a := newTestSQLAuthenticator(t)
+
+	login, err := a.Login("test", "testing")
+	ok(t, err)
+	assert(t, login, "Login failed")
+
+	login, err = a.Login("test", "wrong")
+	ok(t, err)
+	assert(t, !login, "Login succeeded with wrong password")
+
+	login, err = a.Login("nobody", "testing")
+	ok(t, err)
+	assert(t, !login, "Login succeeded for unknown user")
+}
+
+func TestSQLACLs(t *testing.T) {
+	a := newTestSQLAuthenticator(t)
+
+	acls, err := a.GetACLS("test")
+	ok(t, err)
+	equals(t, acls, []*AccessControl{
+		{IP: "*", Name: "testing/*", Actions: []string{"push", "pull"}},
+		{IP: "*", Name: "dev/**", Actions: []string{"pull"}},
+		{IP: "*", Type: "registry", Name: "catalog", Actions: []string{"*"}},
+	})
+
+	groups, err := a.GetGroups("test")
+	ok(t, err)
+	equals(t, groups, []string{"ci", "developers"})
+
+	acls, err = a.GetACLS("robot")
+	ok(t, err)
+	equals(t, len(acls), 0)
+
+	// A permission must belong to exactly one user or group
+	_, err = a.db.Exec(`INSERT INTO permissions (username, group_name, repository, actions) VALUES ('test', 'ops', '**', 'pull')`)
+	assert(t, err != nil, "Expected constraint error")
+
+	// Permissions with an invalid IP deny access but can still be replaced
+	_, err = a.db.Exec(`INSERT INTO permissions (username, ip, repository, actions) VALUES ('robot', '10.0.0.0/33', '**', 'pull')`)
+	ok(t, err)
+	acls, err = a.GetACLS("robot")
+	ok(t, err)
+	equals(t, len(acls), 1)
+	auth := &Authenticator{log: &nullLogger{}}
+	assert(t, !auth.checkIPAddress("10.0.0.1", acls), "Invalid IP permission allowed access")
+
+	user, err := a.GetUser("robot")
+	ok(t, err)
+	equals(t, user.Permissions[0].IP, "10.0.0.0/33")
+	user.Permissions = []*AccessControl{{IP: "10.0.0.0/8", Name: "**", Actions: []string{"pull"}}}
+	ok(t, a.UpdateUser(user))
+	acls, err = a.GetACLS("robot")
+	ok(t, err)
+	assert(t, auth.checkIPAddress("10.0.0.1", acls), "Replaced permission denied access")
+}
+
+func TestSQLRebind(t *testing.T) {
+	a := &SQLAuthenticator{dialect: sqlDialectPostgres}
+	equals(t, a.rebind(`SELECT a FROM b WHERE c = ? AND d = ?`), `SELECT a FROM b WHERE c = $1 AND d = $2`)
+
+	a.dialect = sqlDialectSQLite
+	equals(t, a.rebind(`SELECT a FROM b WHERE c = ?`), `SELECT a FROM b WHERE c = ?`)
+
+	_, err := NewSQLAuthenticator(&SQLConfig{Driver: "mysql"})
+	equals(t, err, ErrSQLUnknownDriver)
+}
+
+func TestSQLUserStore(t *testing.T) {
+	a := newTestSQLAuthenticator(t)
+
+	users, err := a.ListUsers()
+	ok(t, err)
+	equals(t, len(users), 2)
+	equals(t, users[1].Username, "test")
+	equals(t, users[1].Groups, []string{"ci", "developers"})
+	equals(t, users[1].Permissions, []*AccessControl{
+		{IP: "*", Name: "testing/*", Actions: []string{"push", "pull"}},
+	})
+
+	robot := &UserConfig{
+		Username:    "robot2",
+		Password:    "$6$rQg0hrgd$Ve2HTH6dPcKaZM8cZXX99W0oo.XHFEyzBG6WGH7.bs3J1MLMe5ZDgBcu3bB2P5J4O9xgIHpi0XAKKIWM4nKdg/",
+		Groups:      []string{"ops"},
+		Permissions: []*AccessControl{{IP: "10.*", Service: "staging:5000", Name: "builds/**", Actions: []string{"push"}}},
+	}
+	ok(t, a.CreateUser(robot))
+	equals(t, a.CreateUser(robot), ErrUserExists)
+
+	login, err := a.Login("robot2", "testing")
+	ok(t, err)
+	assert(t, login, "Login failed for created user")
+
+	user, err := a.GetUser("robot2")
+	ok(t, err)
+	equals(t, user, robot)
+
+	// Group permissions are included in ACLs but not the user
+	acls, err := a.GetACLS("robot2")
+	ok(t, err)
+	equals(t, len(acls), 2)
+
+	robot.Groups = nil
+	robot.Permissions = robot.Permissions[:0]
+	ok(t, a.UpdateUser(robot))
+	acls, err = a.GetACLS("robot2")
+	ok(t, err)
+	equals(t, len(acls), 0)
+
+	ok(t, a.DeleteUser("robot2"))
+	equals(t, a.DeleteUser("robot2"), ErrUserNotFound)
+	equals(t, a.UpdateUser(robot), ErrUserNotFound)
+	_, err = a.GetUser("robot2")
+	equals(t, err, ErrUserNotFound)
+
+	var count int
+	ok(t, a.db.QueryRow(`SELECT COUNT(*) FROM permissions WHERE username = 'robot2'`).Scan(&count))
+	equals(t, count, 0)
+}
@@ -1,19 +1,24 @@
 package dockerauth
 
 import (
-	"crypto"
-	"crypto/rand"
-	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"strings"
 	"time"
 )
 
+var (
+	ErrInvalidToken = errors.New("Invalid token")
+)
+
 type jwtHeader struct {
-	Alg string `json:"alg"`
-	Typ string `json:"typ"`
-	Kid string `json:"kid"`
+	Alg string   `json:"alg"`
+	Typ string   `json:"typ"`
+	Kid string   `json:"kid"`
+	X5c []string `json:"x5c,omitempty"`
 }
 
 type jwtPayload struct {
@@ -27,39 +32,177 @@ type jwtPayload struct {
 	Access []*AccessControl `json:"access"`
 }
 
-func GenerateToken(username string, accessClaims []*AccessControl) (string, error) {
-	key, err := getPrivateKey()
+// tokenResponse is the body returned from the token endpoints. Token is only
+// set for the legacy GET flow, Scope only for the OAuth2 flow.
+type tokenResponse struct {
+	Token        string `json:"token,omitempty"`
+	AccessToken  string `json:"access_token"`
+	Scope        string `json:"scope,omitempty"`
+	ExpiresIn    int64  `json:"expires_in"`
+	IssuedAt     string `json:"issued_at"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+func newTokenResponse(token string, claims *jwtPayload) *tokenResponse {
+	return &tokenResponse{
+		AccessToken: token,
+		ExpiresIn:   claims.Exp - claims.Iat,
+		IssuedAt:    time.Unix(claims.Iat, 0).UTC().Format(time.RFC3339),
+	}
+}
+
+func writeTokenResponse(w http.ResponseWriter, resp *tokenResponse) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// GenerateToken creates a signed token for username granting accessClaims on
+// the registry named service, valid for the registry's default token lifetime.
+func (a *Authenticator) GenerateToken(service, username string, accessClaims []*AccessControl) (string, error) {
+	reg, err := a.getConfig().getRegistry(service)
 	if err != nil {
 		return "", err
 	}
 
-	now := time.Now()
+	token, _, err := generateToken(reg, username, accessClaims, 0)
+	return token, err
+}
 
-	header := &jwtHeader{
-		Alg: "RS256",
-		Typ: "JWT",
-		Kid: getRSAKeyID(key),
+// generateToken creates a signed token for reg valid for ttl and returns it
+// along with the claims it contains. A zero ttl uses the registry default.
+func generateToken(reg *registry, username string, accessClaims []*AccessControl, ttl time.Duration) (string, *jwtPayload, error) {
+	signer := reg.keys.Active()
+
+	if ttl <= 0 {
+		ttl = reg.defaultTokenTTL()
+	}
+
+	skew := reg.Auth.ClockSkew.Duration
+	if skew <= 0 {
+		skew = defaultClockSkew
 	}
 
+	now := time.Now()
+
+	header := newJWTHeader(signer)
+
 	payload := &jwtPayload{
-		Iss:    config.Registry.Auth.Issuer,
-		Aud:    config.Registry.Name,
+		Iss:    reg.Auth.Issuer,
+		Aud:    reg.Name,
 		Sub:    username,
-		Nbf:    now.Add(-30 * time.Second).Unix(),
-		Exp:    now.Add(time.Hour).Unix(),
+		Nbf:    now.Add(-skew).Unix(),
+		Exp:    now.Add(ttl).Unix(),
 		Iat:    now.Unix(),
 		Access: accessClaims,
 	}
 
 	uuid, err := generateUUID()
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	payload.Jti = uuid
 
+	start := time.Now()
+	token, err := encodeJWT(header, payload, signer)
+	reg.metrics.observeSign(start)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, payload, nil
+}
+
+func (reg *registry) defaultTokenTTL() time.Duration {
+	if reg.Auth.TokenTTL.Duration > 0 {
+		return reg.Auth.TokenTTL.Duration
+	}
+	return defaultTokenTTL
+}
+
+func (reg *registry) refreshTokenTTL() time.Duration {
+	if reg.Auth.RefreshTokenTTL.Duration > 0 {
+		return reg.Auth.RefreshTokenTTL.Duration
+	}
+	return defaultRefreshTokenTTL
+}
+
+// TokenLifetime overrides the registry token lifetimes for a user.
+type TokenLifetime struct {
+	TTL       time.Duration
+	ActionTTL map[string]time.Duration
+}
+
+// TokenLifetimeStore may be implemented by an AccessControlStore to provide
+// per user token lifetimes.
+type TokenLifetimeStore interface {
+	GetTokenLifetime(username string) (*TokenLifetime, error)
+}
+
+// tokenTTL returns the lifetime of a token granting access to username. Each
+// granted action uses its own lifetime if one is configured, otherwise the
+// user or registry default, and the shortest lifetime wins. User settings
+// take precedence over registry settings.
+func (a *Authenticator) tokenTTL(reg *registry, username string, access []*AccessControl) (time.Duration, error) {
+	ttl := reg.defaultTokenTTL()
+	actionTTL := make(map[string]time.Duration, len(reg.Auth.ActionTTL))
+	for action, d := range reg.Auth.ActionTTL {
+		actionTTL[action] = d.Duration
+	}
+
+	if store, ok := a.accessControlStore.(TokenLifetimeStore); ok {
+		lifetime, err := store.GetTokenLifetime(username)
+		if err != nil {
+			return 0, err
+		}
+		if lifetime != nil {
+			if lifetime.TTL > 0 {
+				ttl = lifetime.TTL
+			}
+			for action, d := range lifetime.ActionTTL {
+				actionTTL[action] = d
+			}
+		}
+	}
+
+	var shortest time.Duration
+	for _, acl := range access {
+		for _, action := range acl.Actions {
+			d, exists := actionTTL[action]
+			if !exists || d <= 0 {
+				d = ttl
+			}
+			if shortest == 0 || d < shortest {
+				shortest = d
+			}
+		}
+	}
+
+	if shortest == 0 {
+		return ttl, nil
+	}
+	return shortest, nil
+}
+
+// newJWTHeader returns the header for a token signed by signer. If the key has
+// a certificate configured its chain is embedded so the registry can validate
+// the key against its trusted CA rather than by key ID.
+func newJWTHeader(signer Signer) *jwtHeader {
+	header := &jwtHeader{
+		Alg: signer.Alg(),
+		Typ: "JWT",
+		Kid: signer.KeyID(),
+	}
+
+	if key, ok := signer.(*keySetEntry); ok {
+		header.X5c = key.x5c
+	}
+	return header
+}
+
+func encodeJWT(header *jwtHeader, payload interface{}, signer Signer) (string, error) {
 	headerEncoded := jsonEncodeJWTSection(header)
 	payloadEncoded := jsonEncodeJWTSection(payload)
-	signature, err := signJWT(headerEncoded, payloadEncoded, key)
+	signature, err := signer.Sign(jwtSigningInput(headerEncoded, payloadEncoded))
 	if err != nil {
 		return "", err
 	}
@@ -68,22 +211,59 @@ func GenerateToken(username string, accessClaims []*AccessControl) (string, erro
 	return fmt.Sprintf("%s.%s.%s", headerEncoded, payloadEncoded, signature), nil
 }
 
+// decodeJWT verifies the signature of a token created by encodeJWT with any
+// key in keys and unmarshals its payload into v.
+func decodeJWT(token string, v interface{}, keys *KeySet) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+
+	header := &jwtHeader{}
+	if err := jsonDecodeJWTSection([]byte(parts[0]), header); err != nil {
+		return ErrInvalidToken
+	}
+	signer := keys.Lookup(header.Kid)
+	if signer == nil || header.Alg != signer.Alg() {
+		return ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if err := signer.Verify(jwtSigningInput([]byte(parts[0]), []byte(parts[1])), signature); err != nil {
+		return ErrInvalidToken
+	}
+
+	if err := jsonDecodeJWTSection([]byte(parts[1]), v); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
 func jsonEncodeJWTSection(i interface{}) []byte {
 	JSON, _ := json.Marshal(i)
 	return base64Encode(JSON)
 }
 
+func jsonDecodeJWTSection(src []byte, v interface{}) error {
+	JSON, err := base64.RawURLEncoding.DecodeString(string(src))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(JSON, v)
+}
+
 func base64Encode(src []byte) []byte {
 	encoded := make([]byte, base64.RawURLEncoding.EncodedLen(len(src)))
 	base64.RawURLEncoding.Encode(encoded, src)
 	return encoded
 }
 
-func signJWT(header, payload []byte, key *rsa.PrivateKey) ([]byte, error) {
-	hasher := crypto.SHA256.New()
-	message := append(header, '.')
-	message = append(message, payload...)
-	hasher.Write(message)
-	sigBytes, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hasher.Sum(nil))
-	return sigBytes, err
+func jwtSigningInput(header, payload []byte) []byte {
+	message := make([]byte, 0, len(header)+len(payload)+1)
+	message = append(message, header...)
+	message = append(message, '.')
+	return append(message, payload...)
 }
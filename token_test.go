@@ -0,0 +1,96 @@
+package dockerauth
+
+import (
+	"testing"
+	"time"
+)
+
+type testLifetimeStore struct {
+	testUserStore
+	lifetimes map[string]*TokenLifetime
+}
+
+func (s *testLifetimeStore) GetTokenLifetime(username string) (*TokenLifetime, error) {
+	return s.lifetimes[username], nil
+}
+
+var tokenTTLTests = []struct {
+	username string
+	access   []*AccessControl
+	expected time.Duration
+}{
+	{
+		username: "test",
+		access:   []*AccessControl{},
+		expected: 2 * time.Hour,
+	},
+	{
+		username: "test",
+		access: []*AccessControl{
+			{Actions: []string{"pull"}},
+		},
+		expected: 2 * time.Hour,
+	},
+	{
+		username: "test",
+		access: []*AccessControl{
+			{Actions: []string{"pull"}},
+			{Actions: []string{"push", "pull"}},
+		},
+		expected: 5 * time.Minute,
+	},
+	{
+		username: "robot",
+		access: []*AccessControl{
+			{Actions: []string{"pull"}},
+		},
+		expected: 24 * time.Hour,
+	},
+	{
+		username: "robot",
+		access: []*AccessControl{
+			{Actions: []string{"pull", "push"}},
+		},
+		expected: time.Minute,
+	},
+}
+
+func TestTokenTTL(t *testing.T) {
+	reg := &registry{RegistryConfig: &RegistryConfig{}}
+	reg.Auth.TokenTTL = Duration{2 * time.Hour}
+	reg.Auth.ActionTTL = map[string]Duration{
+		"push": {5 * time.Minute},
+	}
+
+	a := &Authenticator{
+		accessControlStore: &testLifetimeStore{
+			lifetimes: map[string]*TokenLifetime{
+				"robot": {
+					TTL:       24 * time.Hour,
+					ActionTTL: map[string]time.Duration{"push": time.Minute},
+				},
+			},
+		},
+	}
+
+	for _, test := range tokenTTLTests {
+		ttl, err := a.tokenTTL(reg, test.username, test.access)
+		ok(t, err)
+		equals(t, ttl, test.expected)
+	}
+}
+
+func TestGenerateTokenTTL(t *testing.T) {
+	a := newTestAuthenticator()
+	reg := testRegistry(a)
+	reg.Auth.ClockSkew = Duration{time.Minute}
+
+	_, claims, err := generateToken(reg, "test", nil, 10*time.Minute)
+	ok(t, err)
+	equals(t, claims.Exp-claims.Iat, int64(600))
+	equals(t, claims.Iat-claims.Nbf, int64(60))
+
+	_, claims, err = generateToken(reg, "test", nil, 0)
+	ok(t, err)
+	equals(t, claims.Exp-claims.Iat, int64(3600))
+}